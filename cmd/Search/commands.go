@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/cptaffe/acme-search/fuzzy"
+)
+
+// Execute runs a command executed in the window, reporting whether it was
+// handled. Unhandled commands fall through to acme.
+func (s *Search) Execute(ctx context.Context, cmd string) (bool, error) {
+	if command, ok := strings.CutPrefix(strings.TrimSpace(cmd), "|"); ok {
+		return true, s.Pipe(ctx, command)
+	}
+	verb, _, _ := strings.Cut(strings.TrimSpace(cmd), " ")
+	s.lock.Lock()
+	confirmed := s.confirm == verb
+	s.confirm = ""
+	s.lock.Unlock()
+
+	switch verb {
+	case "Explain":
+		return true, s.Explain(ctx)
+	case "More":
+		return true, s.More(ctx)
+	case "Tree":
+		return true, s.Tree(ctx)
+	case "Preview":
+		return true, s.Preview()
+	case "Mark":
+		return true, s.Mark(ctx)
+	case "OpenAll":
+		return true, s.OpenAll(confirmed)
+	case "OpenFiles":
+		return true, s.OpenFiles(confirmed)
+	case "Put":
+		// Results are not a file, don't write one named +Search
+		return true, nil
+	}
+	return false, nil
+}
+
+// Explain toggles showing how each result's score breaks down
+func (s *Search) Explain(ctx context.Context) error {
+	s.lock.Lock()
+	s.explain = !s.explain
+	s.lock.Unlock()
+
+	return s.rerender(ctx)
+}
+
+// Tree toggles showing results as a directory tree
+func (s *Search) Tree(ctx context.Context) error {
+	s.lock.Lock()
+	s.tree = !s.tree
+	s.lock.Unlock()
+
+	return s.rerender(ctx)
+}
+
+// More shows another page of the retained results, without searching again
+func (s *Search) More(ctx context.Context) error {
+	s.lock.Lock()
+	s.pages++
+	s.lock.Unlock()
+
+	return s.rerender(ctx)
+}
+
+// Expand shows every retained result in file
+func (s *Search) Expand(ctx context.Context, file string) error {
+	s.lock.Lock()
+	if s.expanded == nil {
+		s.expanded = make(map[string]bool)
+	}
+	s.expanded[file] = true
+	s.lock.Unlock()
+
+	return s.rerender(ctx)
+}
+
+// OpenAll plumbs every result selected, once confirmed should there be more
+// than MaxOpen
+func (s *Search) OpenAll(confirmed bool) error {
+	s.lock.Lock()
+	var targets []Target
+	for _, result := range s.selected() {
+		if target, ok := plumbTarget(result); ok && !slices.Contains(targets, target) {
+			targets = append(targets, target)
+		}
+	}
+	s.lock.Unlock()
+
+	return s.open("OpenAll", "results", targets, confirmed)
+}
+
+// OpenFiles plumbs each file of the results selected once, once confirmed
+// should there be more than MaxOpen
+func (s *Search) OpenFiles(confirmed bool) error {
+	s.lock.Lock()
+	var targets []Target
+	for _, result := range s.selected() {
+		target, ok := plumbTarget(result)
+		target.Address = "" // at the top
+		if ok && !slices.Contains(targets, target) {
+			targets = append(targets, target)
+		}
+	}
+	s.lock.Unlock()
+
+	return s.open("OpenFiles", "files", targets, confirmed)
+}
+
+// open plumbs targets, asking that cmd be executed again to confirm
+// opening more than MaxOpen
+func (s *Search) open(cmd, what string, targets []Target, confirmed bool) error {
+	if len(targets) > MaxOpen && !confirmed {
+		s.lock.Lock()
+		s.confirm = cmd
+		s.lock.Unlock()
+		return fmt.Errorf("%d %s, execute %s again to open them all", len(targets), what, cmd)
+	}
+	return s.plumb(targets...)
+}
+
+// selected returns the marked results, or without any the results shown,
+// never their context lines. Called with s.lock held.
+func (s *Search) selected() []*Result {
+	var results []*Result
+	for _, result := range s.retained {
+		if s.marked[markKey(result)] {
+			results = append(results, result)
+		}
+	}
+	if len(results) > 0 {
+		return results
+	}
+
+	context := s.contextLines()
+	for _, result := range s.results {
+		if !context[result] {
+			results = append(results, result)
+		}
+	}
+	return results
+}
+
+// contextLines of the results shown. Called with s.lock held.
+func (s *Search) contextLines() map[*Result]bool {
+	context := make(map[*Result]bool)
+	for _, result := range s.results {
+		for _, line := range result.Context {
+			context[line] = true
+		}
+	}
+	return context
+}
+
+// Mark toggles marking the results within dot
+func (s *Search) Mark(ctx context.Context) error {
+	// Rendering sets addr too, don't interleave
+	s.lock.Lock()
+	err := s.win.Ctl("addr=dot")
+	if err != nil {
+		s.lock.Unlock()
+		return fmt.Errorf("addr=dot: %w", err)
+	}
+	q0, q1, err := s.win.ReadAddr()
+	if err != nil {
+		s.lock.Unlock()
+		return fmt.Errorf("read addr: %w", err)
+	}
+
+	context := s.contextLines()
+	for i, r := range s.ranges {
+		if r.Start < max(q1, q0+1) && q0 < r.End && !context[s.results[i]] {
+			s.toggleMark(s.results[i])
+		}
+	}
+	s.lock.Unlock()
+
+	return s.rerender(ctx)
+}
+
+// MarkAt toggles marking the result at q0, reporting whether there was one
+func (s *Search) MarkAt(ctx context.Context, q0 int) (bool, error) {
+	s.lock.Lock()
+	result := s.resultAt(q0)
+	if result == nil || s.contextLines()[result] {
+		s.lock.Unlock()
+		return false, nil
+	}
+	s.toggleMark(result)
+	s.lock.Unlock()
+
+	return true, s.rerender(ctx)
+}
+
+// toggleMark marks result, or unmarks it. Called with s.lock held.
+func (s *Search) toggleMark(result *Result) {
+	if s.marked == nil {
+		s.marked = make(map[Addr]bool)
+	}
+	key := markKey(result)
+	if s.marked[key] {
+		delete(s.marked, key)
+	} else {
+		s.marked[key] = true
+	}
+}
+
+// markKey identifies result across searches, by its address or path
+func markKey(result *Result) Addr {
+	if result.Addr != nil {
+		return *result.Addr
+	}
+	return Addr{File: result.Text}
+}
+
+// rerender writes the retained results again, after a change to how
+// they are shown
+func (s *Search) rerender(ctx context.Context) error {
+	s.lock.Lock()
+	results, statuses := s.retained, s.statuses
+	s.lock.Unlock()
+
+	return s.writeResults(ctx, results, statuses)
+}
+
+// explanation of how result scored against the current query
+func (s *Search) explanation(result *Result) string {
+	if result.Edits > 0 {
+		return fmt.Sprintf("score %.3f: approximate, %d edits", result.Score, result.Edits)
+	}
+	opts := fuzzy.DefaultOptions
+	if result.Source != nil {
+		opts = result.Source.Options
+	}
+	return fuzzy.NewMatcher(opts).Explain(s.Query(), result.Text).String()
+}
@@ -1,22 +1,18 @@
-// TODO: Mark clean when all results are in
 // TODO: Update working directory of sourceCommand based on window name changes
-// TODO: Look on file name should not redirect to last symbol of previous file (need q0 for file lines)
-// TODO: Tree mode: display results like tree, grouped by shared parent -- great with +f for find mode (match on file name, not contents)
 package main
 
 import (
-	"bufio"
+	"bytes"
 	"cmp"
-	"container/heap"
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
-	"regexp"
 	"slices"
 	"strconv"
 	"strings"
@@ -24,6 +20,7 @@ import (
 	"syscall"
 	"time"
 	"unicode"
+	"unicode/utf8"
 
 	"9fans.net/go/acme"
 	"github.com/cptaffe/acme-search/fuzzy"
@@ -45,6 +42,46 @@ func (r Range) Compare(i int) int {
 	return 0 // within
 }
 
+// Edit adjusts r for an edit replacing [q0, q1) with n runes, containing
+// a newline if nl. It reports false should r no longer hold just its own
+// line: when the edit splits the line, or joins it to another.
+func (r Range) Edit(q0, q1, n int, nl bool) (Range, bool) {
+	switch {
+	case q1 < r.Start || q0 < q1 && q1 == r.Start:
+		// Before, insertions at the start of a line join it
+		d := n - (q1 - q0)
+		return Range{r.Start + d, r.End + d}, true
+	case q0 >= r.End:
+		return r, true // after
+	case !nl && q0 >= r.Start && q1 < r.End:
+		// Within the line, sparing its newline
+		return Range{r.Start, r.End + n - (q1 - q0)}, true
+	}
+	return Range{}, false
+}
+
+// runeBuilder is a strings.Builder counting the runes written, as Acme
+// addresses text in runes
+type runeBuilder struct {
+	strings.Builder
+	runes int
+}
+
+func (b *runeBuilder) Write(p []byte) (int, error) {
+	b.runes += utf8.RuneCount(p)
+	return b.Builder.Write(p)
+}
+
+func (b *runeBuilder) WriteString(s string) (int, error) {
+	b.runes += utf8.RuneCountInString(s)
+	return b.Builder.WriteString(s)
+}
+
+// Runes counts the runes written, the offset of the next
+func (b *runeBuilder) Runes() int {
+	return b.runes
+}
+
 type Search struct {
 	lock    sync.Mutex
 	cancel  context.CancelFunc
@@ -53,6 +90,29 @@ type Search struct {
 	ranges  []Range   // ranges of results
 	results []*Result // results
 	win     *acme.Win
+
+	statuses []Status  // of the sources of the rendered results
+	retained []*Result // all results of the latest render, shown or not
+
+	// Paging through retained results
+	pages    int             // shown beyond the first, see More
+	expanded map[string]bool // files showing all their results, see Expand
+	headers  []Header        // ranges of file group headers
+	more     Range           // range of the "… N more" line, if any
+	explain  bool            // show score breakdowns, see Explain
+	tree     bool            // show results as a directory tree, see Tree
+	preview  bool            // show looked at results in +Preview, see Preview
+	confirm  string          // command to run should it be executed again
+	marked   map[Addr]bool   // results acted on in place of all shown, see Mark
+	root     string          // of the latest search, that result paths are relative to
+	complete bool            // whether the latest search has finished, see markClean
+
+	previewWin *acme.Win // reused for every preview, deleted with the window
+
+	// Results of the latest rendered search, rescored when its query is refined
+	candidates      []*Result
+	candidatesQuery string
+	candidatesFlags []Flag
 }
 
 type Flag rune
@@ -63,13 +123,104 @@ const (
 	FlagGrep    Flag = 'g' // Search contents of files recursively using rg, see also: plan9port/bin/g
 	FlagFiles   Flag = 'f' // Search files recursively by name
 
-	MaxLineLength    string        = "2048"
-	MaxResults       int           = 100
-	DebounceDuration time.Duration = 100 * time.Millisecond
+	MaxLineLength      int           = 2048
+	MaxResults         int           = 100
+	MaxResultsPerFile  int           = 5
+	MaxRetained        int           = 1000 // results kept for paging, see More
+	MaxRetainedPerFile int           = 50   // results kept per file for expanding, see Expand
+	BatchSize          int           = 4096 // results scored together, see fuzzy.MatchAll
+	DebounceDuration   time.Duration = 100 * time.Millisecond
+	ApproxThreshold    int           = 10               // fewest exact matches before approximate ones are dropped
+	MaxEdits           int           = 2                // see fuzzy.MatchApprox
+	SourceTimeout      time.Duration = 30 * time.Second // for sources without their own Timeout
+	SearchTimeout      time.Duration = time.Minute      // after which a search is complete
+	MaxContextLines    int           = 10               // before and after each match
+	PreviewLines       int           = 10               // shown either side of a previewed line
+	MaxOpen            int           = 20               // opened at once without confirmation, see OpenAll
 )
 
 var DefaultFlags []Flag = []Flag{FlagSymbols, FlagWindows, FlagGrep}
 
+// Source is a search backend, enabled by its flag
+type Source struct {
+	Name    string
+	Flag    Flag
+	Options fuzzy.Options // scoring profile for the source's results
+	Format  Format        // output format of a command source
+	Timeout time.Duration // after which the source is abandoned, see SourceTimeout
+	Paths   bool          // results are file paths, without addresses
+	Run     func(ctx context.Context, src *Source, query, path string, lines int, ch chan<- *Result) error
+}
+
+var Sources []*Source = []*Source{
+	{
+		Name:    "L sym",
+		Flag:    FlagSymbols,
+		Options: fuzzy.SymbolOptions,
+		Format:  FormatGuess,
+		Timeout: 10 * time.Second, // language servers may hang
+		Run: func(ctx context.Context, src *Source, query, path string, lines int, ch chan<- *Result) error {
+			return commandSource(ctx, src, []string{"L", "sym", "-p", query}, ch)
+		},
+	},
+	{
+		Name:    "windows",
+		Flag:    FlagWindows,
+		Options: fuzzy.PathOptions,
+		Paths:   true,
+		Run: func(ctx context.Context, src *Source, query, path string, lines int, ch chan<- *Result) error {
+			return indexSource(ctx, src, ch)
+		},
+	},
+	{
+		Name:    "ripgrep",
+		Flag:    FlagGrep,
+		Options: fuzzy.TextOptions,
+		Format:  FormatJSON,
+		Run: func(ctx context.Context, src *Source, query, path string, lines int, ch chan<- *Result) error {
+			return commandSource(ctx, src, []string{"rg", "--json", "--context", strconv.Itoa(lines), query, path}, ch)
+		},
+	},
+	{
+		Name:    "ripgrep",
+		Flag:    FlagFiles,
+		Options: fuzzy.PathOptions,
+		Format:  FormatPaths, // rg --json does not apply to --files
+		Paths:   true,
+		Run: func(ctx context.Context, src *Source, query, path string, lines int, ch chan<- *Result) error {
+			return commandSource(ctx, src, []string{"rg", "--max-columns", strconv.Itoa(MaxLineLength), "--iglob", "*" + query + "*", "--files", path}, ch)
+		},
+	},
+}
+
+func (src *Source) timeout() time.Duration {
+	if src.Timeout == 0 {
+		return SourceTimeout
+	}
+	return src.Timeout
+}
+
+func SourceFor(flag Flag) *Source {
+	for _, src := range Sources {
+		if src.Flag == flag {
+			return src
+		}
+	}
+	return nil
+}
+
+// Matchers keeps a reusable Matcher per Source, scoring with its profile
+type Matchers map[*Source]*fuzzy.Matcher
+
+func (ms Matchers) For(src *Source) *fuzzy.Matcher {
+	m, ok := ms[src]
+	if !ok {
+		m = fuzzy.NewMatcher(src.Options)
+		ms[src] = m
+	}
+	return m
+}
+
 // Flags can enable additional functionality
 func (s *Search) Flags() []Flag {
 	parts := strings.SplitN(strings.TrimSpace(strings.TrimPrefix(s.query, s.prompt)), "+", 2)
@@ -78,67 +229,75 @@ func (s *Search) Flags() []Flag {
 		for i, r := range parts[1] {
 			flags[i] = Flag(r)
 		}
+		if strings.Trim(parts[1], "0123456789") == "" && parts[1] != "" {
+			// Only a count, of context lines for the default sources
+			return append(slices.Clone(DefaultFlags), flags...)
+		}
 		return flags
 	}
 	return DefaultFlags
 }
 
+// ContextLines counts the lines of context to show around each match, as
+// set by digits among flags, e.g. +g2
+func ContextLines(flags []Flag) int {
+	n := 0
+	for _, flag := range flags {
+		if flag >= '0' && flag <= '9' {
+			n = n*10 + int(flag-'0')
+		}
+	}
+	return min(n, MaxContextLines)
+}
+
 func (s *Search) Query() string {
 	return strings.SplitN(strings.TrimSpace(strings.TrimPrefix(s.query, s.prompt)), "+", 2)[0]
 }
 
-var twoColonRangeRegexp = regexp.MustCompile(`(.*):([0-9]+).([0-9]+)[:,]([0-9]+).([0-9]+)[: ](.*)`)
-var twoColonAddrRegexp = regexp.MustCompile(`(.*):([0-9]+)[:,]([0-9]+)[: ](.*)`)
-
-func commandSource(ctx context.Context, command []string, ch chan<- *Result) error {
+func commandSource(ctx context.Context, src *Source, command []string, ch chan<- *Result) error {
 	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
-	cmd.Stderr = os.Stderr
+	var stderr lastLine
+	cmd.Stderr = io.MultiWriter(os.Stderr, &stderr)
 	r, err := cmd.StdoutPipe()
 	if err != nil {
 		return fmt.Errorf("stdout pipe: %w", err)
 	}
 	defer r.Close()
 	err = cmd.Start()
+	if errors.Is(err, exec.ErrNotFound) {
+		return fmt.Errorf("%s: %w", command[0], exec.ErrNotFound)
+	}
 	if err != nil {
 		return fmt.Errorf("start command: %w", err)
 	}
 
-	// TODO: Allow lines longer than 64k, use regexp.MatchReader with regexp incorporating : prefix grammar and max lengths, then consume up to newline or EOF.
+	// Unblock reads should the command's children keep stdout open
+	stop := context.AfterFunc(ctx, func() { r.Close() })
+	defer stop()
 
-	scanner := bufio.NewScanner(r)
-	for scanner.Scan() {
-		line := scanner.Text()
-		var res Result
-		if matches := twoColonRangeRegexp.FindStringSubmatch(line); matches != nil {
-			res.Addr = &Addr{
-				File:       matches[1],
-				FromLine:   matches[2],
-				FromColumn: matches[3],
-				ToLine:     matches[4],
-				ToColumn:   matches[5],
-			}
-			res.Text = matches[6]
-		} else if matches := twoColonAddrRegexp.FindStringSubmatch(line); matches != nil {
-			res.Addr = &Addr{
-				File:       matches[1],
-				FromLine:   matches[2],
-				FromColumn: matches[3],
-			}
-			res.Text = matches[4]
-		} else {
-			res.Text = line
+	parser := NewParser(src.Format, r)
+	for {
+		res, err := parser.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			return fmt.Errorf("parse: %w", err)
+		}
+		res.Source = src
+		for _, line := range res.Context {
+			line.Source = src
 		}
 
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
-		case ch <- &res:
+		case ch <- res:
 		}
 	}
-	err = scanner.Err()
-	if err != nil {
-		return fmt.Errorf("scanning: %w", err)
-	}
 	err = cmd.Wait()
 	if err != nil {
 		select {
@@ -147,6 +306,10 @@ func commandSource(ctx context.Context, command []string, ch chan<- *Result) err
 		default:
 			// e.g. 'exit status 1', representing no results found
 			if _, ok := err.(*exec.ExitError); ok {
+				// Unless the command explained itself, e.g. a bad regexp
+				if msg := stderr.String(); msg != "" {
+					return errors.New(msg)
+				}
 				return nil // swallow
 			}
 			return fmt.Errorf("wait: %w", err)
@@ -155,7 +318,46 @@ func commandSource(ctx context.Context, command []string, ch chan<- *Result) err
 	return nil
 }
 
-func indexSource(ctx context.Context, ch chan<- *Result) error {
+// lastLine keeps the last non-blank line written to it, up to
+// MaxLineLength bytes of it, as a command may write much more to stderr
+// than the status line shows
+type lastLine struct {
+	line    []byte // last complete line
+	partial []byte // line written so far
+}
+
+func (l *lastLine) Write(p []byte) (int, error) {
+	n := len(p)
+	for {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			l.partial = appendMax(l.partial, p)
+			return n, nil
+		}
+		l.partial = appendMax(l.partial, p[:i])
+		if len(bytes.TrimSpace(l.partial)) > 0 {
+			l.line = append(l.line[:0], l.partial...)
+		}
+		l.partial = l.partial[:0]
+		p = p[i+1:]
+	}
+}
+
+// appendMax appends p to b, up to MaxLineLength bytes
+func appendMax(b, p []byte) []byte {
+	return append(b, p[:min(len(p), max(MaxLineLength-len(b), 0))]...)
+}
+
+func (l *lastLine) String() string {
+	line := l.line
+	if len(bytes.TrimSpace(l.partial)) > 0 {
+		line = l.partial // unterminated
+	}
+	// The line may have been cut within a rune
+	return strings.ToValidUTF8(strings.TrimSpace(string(line)), "")
+}
+
+func indexSource(ctx context.Context, src *Source, ch chan<- *Result) error {
 	windows, err := acme.Windows()
 	if err != nil {
 		return fmt.Errorf("windows: %w", err)
@@ -164,12 +366,14 @@ func indexSource(ctx context.Context, ch chan<- *Result) error {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
-		case ch <- &Result{Text: win.Name}:
+		case ch <- &Result{Text: win.Name, Source: src}:
 		}
 	}
 	return nil
 }
 
+// Addr locates a result. Lines and columns count from 1, columns in
+// runes, with ToColumn just past the end of the range.
 type Addr struct {
 	File       string
 	FromLine   string
@@ -178,27 +382,45 @@ type Addr struct {
 	ToColumn   string
 }
 
+// String formats the address as file:addr, where addr is an Acme address.
+// Acme has no column syntax, so a column c of line l is written as the
+// position c-1 characters past the start of the line, l-#0+#(c-1).
 func (a Addr) String() string {
-	s := a.File
-	if a.FromLine != "" {
-		s += ":" + a.FromLine
-		if a.FromColumn != "" {
-			s += "." + a.FromColumn
-		}
-		if a.ToLine != "" {
-			s += "," + a.ToLine
-			if a.ToColumn != "" {
-				s += "." + a.ToColumn
-			}
-		}
+	if address := a.Address(); address != "" {
+		return a.File + ":" + address
+	}
+	return a.File
+}
+
+// Address formats the Acme address within the file, if any
+func (a Addr) Address() string {
+	if a.FromLine == "" {
+		return ""
+	}
+	s := position(a.FromLine, a.FromColumn)
+	if a.ToLine != "" {
+		s += "," + position(a.ToLine, a.ToColumn)
 	}
 	return s
 }
 
+// position formats an Acme address for a line, and column if valid
+func position(line, column string) string {
+	c, err := strconv.Atoi(column)
+	if err != nil || c < 1 {
+		return line
+	}
+	return fmt.Sprintf("%s-#0+#%d", line, c-1)
+}
+
 type Result struct {
-	Text  string
-	Addr  *Addr
-	Score fuzzy.Score
+	Text    string
+	Addr    *Addr
+	Score   fuzzy.Score
+	Edits   int       // edits to the query for an approximate match
+	Matches []Range   // byte ranges within Text matched by the source
+	Context []*Result // lines around the match, by line, see ContextLines
+	Source  *Source
 }
 
 func (r Result) Equals(o *Result) bool {
@@ -210,22 +432,28 @@ func (r Result) String() string {
 	return fmt.Sprintf("%s\n%s\n", r.Addr, r.Text)
 }
 
-type ResultHeap []*Result
-
-func (h ResultHeap) Len() int           { return len(h) }
-func (h ResultHeap) Less(i, j int) bool { return h[i].Score > h[j].Score }
-func (h ResultHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
-
-func (h *ResultHeap) Push(x any) {
-	*h = append(*h, x.(*Result))
+// Compare ranks results by score, exact matches above approximate ones.
+// Ties prefer results in shallower, then shorter, paths.
+func (r *Result) Compare(o *Result) int {
+	if c := cmp.Compare(o.Edits, r.Edits); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(r.Score, o.Score); c != 0 {
+		return c
+	}
+	rp, op := r.Path(), o.Path()
+	if c := cmp.Compare(strings.Count(op, "/"), strings.Count(rp, "/")); c != 0 {
+		return c
+	}
+	return cmp.Compare(len(op), len(rp))
 }
 
-func (h *ResultHeap) Pop() any {
-	old := *h
-	n := len(old)
-	x := old[n-1]
-	*h = old[0 : n-1]
-	return x
+// Path of the file the result is in, or of the result itself
+func (r *Result) Path() string {
+	if r.Addr != nil {
+		return r.Addr.File
+	}
+	return r.Text
 }
 
 func (s *Search) Search(ctx context.Context) {
@@ -236,6 +464,13 @@ func (s *Search) Search(ctx context.Context) {
 	case <-time.After(DebounceDuration):
 	}
 
+	// Results are incomplete until the search finishes
+	s.complete = false
+	err := s.win.Ctl("dirty")
+	if err != nil {
+		log.Printf("mark dirty: %v", err)
+	}
+
 	// Use the search window's path as the search root
 	// TODO: Track changes here via Ki events
 	path := "."
@@ -250,107 +485,111 @@ func (s *Search) Search(ctx context.Context) {
 		log.Printf("cannot determine filename in tag %q", tag)
 	}
 	path = filepath.Dir(tag[:i])
+	s.root = path
 
-	ch := make(chan *Result)
+	ch := make(chan *Result, BatchSize)
 	query := s.Query()
 	flags := s.Flags()
+	lines := ContextLines(flags)
+	refined := s.refine(query, flags)
+	start := time.Now()
+	sourcesCtx, cancelSources := context.WithTimeout(ctx, SearchTimeout)
+	done := make(chan sourceDone, len(flags))
+	var sources []*Source
 	var wg sync.WaitGroup
 	for _, flag := range flags {
-		wg.Add(1)
-		switch flag {
-		case FlagSymbols:
-			go func() {
-				defer wg.Done()
-				err := commandSource(ctx, []string{"L", "sym", "-p", query}, ch)
-				if err != nil && !errors.Is(err, context.Canceled) {
-					log.Printf("L sym: %v", err)
-				}
-			}()
-		case FlagWindows:
-			go func() {
-				defer wg.Done()
-				err := indexSource(ctx, ch)
-				if err != nil && !errors.Is(err, context.Canceled) {
-					log.Printf("windows: %v", err)
-				}
-			}()
-		case FlagGrep:
-			go func() {
-				defer wg.Done()
-				err := commandSource(ctx, []string{"rg", "--max-columns", MaxLineLength, query, path}, ch)
-				if err != nil && !errors.Is(err, context.Canceled) {
-					log.Printf("ripgrep: %v", err)
-				}
-			}()
-		case FlagFiles:
-			go func() {
-				defer wg.Done()
-				err := commandSource(ctx, []string{"rg", "--max-columns", MaxLineLength, "--iglob", "*" + query + "*", "--files", path}, ch)
-				if err != nil && !errors.Is(err, context.Canceled) {
-					log.Printf("ripgrep: %v", err)
-				}
-			}()
-		default:
-			wg.Done()
+		if unicode.IsDigit(rune(flag)) {
+			continue // see ContextLines
+		}
+		src := SourceFor(flag)
+		if src == nil {
 			log.Printf("unknown flag: %c", flag)
+			continue
+		}
+		if slices.Contains(sources, src) {
+			continue
 		}
+		sources = append(sources, src)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(sourcesCtx, src.timeout())
+			defer cancel()
+			err := src.Run(ctx, src, query, path, lines, ch)
+			if err != nil && !errors.Is(err, context.Canceled) {
+				log.Printf("%s: %v", src.Name, err)
+			}
+			done <- sourceDone{src, err} // buffered for every source
+		}()
 	}
 	// Close channel only when all writers are finished
 	go func() {
 		wg.Wait()
+		cancelSources()
 		close(ch)
 	}()
 	go func() {
-		var results ResultHeap
+		results := NewTopResults(MaxRetained, MaxRetainedPerFile)
+		var (
+			matchers = make(Matchers)
+			batch    []*Result
+			bySource = make(map[*Source][]*Result)
+			texts    []string
+			exact    int // results matching without edits
+			approx   = fuzzy.NewApprox(query, MaxEdits)
+		)
+		statuses := make([]Status, len(sources))
+		for i, src := range sources {
+			statuses[i].Source = src
+		}
+		status := func(src *Source) *Status {
+			return &statuses[slices.Index(sources, src)]
+		}
+		statusVersion := 0
+		// Refined candidates stand in for a source's results only until it
+		// finishes, what it returns again decides what remains
+		provisional := refined
+		finish := func(d sourceDone) {
+			st := status(d.src)
+			st.Done, st.Err, st.Elapsed = true, d.err, time.Since(start)
+			provisional = slices.DeleteFunc(provisional, func(r *Result) bool { return r.Source == d.src })
+			statusVersion++
+		}
+
 		hasRendered := false
-		heap.Init(&results)
-		lastLen := results.Len()
+		lastVersion := results.Version() + statusVersion
 		// Wait duration before we render -- total 2*duration delay
 		shouldRender := time.Now().Add(DebounceDuration)
+		if len(refined) > 0 {
+			shouldRender = time.Now() // show refined candidates while sources rerun
+		}
 
 		// Debounce render
 		render := func() error {
 			// Render at least once, avoid re-rendering same results
-			currentLen := results.Len()
-			if hasRendered && currentLen == lastLen {
+			currentVersion := results.Version() + statusVersion
+			if hasRendered && currentVersion == lastVersion {
 				return nil
 			}
 			hasRendered = true
 
-			topN := make([]*Result, max(results.Len(), MaxResults))
-			seenAtAddr := make(map[Addr]struct{})
-			seenInFile := make(map[string]int)
-			i := 0
-			for i < MaxResults && results.Len() > 0 {
-				result := heap.Pop(&results).(*Result)
-				topN[i] = result
-				if result.Addr == nil {
-					i++
-					continue
-				}
-				_, isDup := seenAtAddr[*result.Addr]
-				if !isDup {
-					seenAtAddr[*result.Addr] = struct{}{}
-				}
-				count := seenInFile[result.Addr.File]
-				seenInFile[result.Addr.File] = count + 1
-				if i == 0 || (count < 5 && !isDup) {
-					i++
-				}
+			sorted := results.Sorted()
+			if len(provisional) > 0 {
+				sorted = mergeResults(sorted, provisional)
 			}
-			topN = topN[:i] // truncate unused slots
-			// TODO: Use btree to avoid mutation on read
-			for _, result := range topN {
-				heap.Push(&results, result)
+			if exact >= ApproxThreshold {
+				// Approximate results rank last, drop them
+				sorted = slices.DeleteFunc(sorted, func(r *Result) bool { return r.Edits > 0 })
 			}
-			err := s.writeResults(ctx, topN)
+			err := s.writeResults(ctx, sorted, slices.Clone(statuses))
 			if err != nil {
 				return fmt.Errorf("write line: %w", err)
 			}
+			s.keep(ctx, query, flags, sorted)
 
 			// Reset timer
 			shouldRender = time.Now().Add(DebounceDuration)
-			lastLen = results.Len() // may have changed
+			lastVersion = currentVersion
 			return nil
 		}
 
@@ -364,36 +603,178 @@ func (s *Search) Search(ctx context.Context) {
 					log.Printf("render: %v", err)
 					return
 				}
+			case d := <-done:
+				finish(d)
 			case result, ok := <-ch:
 				if !ok {
+					// Every source reported done before the channel closed
+					for len(done) > 0 {
+						finish(<-done)
+					}
 					err := render()
 					if err != nil {
 						log.Printf("render: %v", err)
+						return
+					}
+					// All results are in
+					err = s.markClean(ctx)
+					if err != nil {
+						log.Printf("mark clean: %v", err)
 					}
 					return
 				}
 
-				// Rewrite path as relative
-				if result.Addr != nil {
-					result.Addr.File, _ = strings.CutPrefix(result.Addr.File, path+"/")
+				// Score whatever else is ready as one batch
+				batch = append(batch[:0], result)
+			drain:
+				for len(batch) < BatchSize {
+					select {
+					case result, ok := <-ch:
+						if !ok {
+							break drain // closed, seen again on the next receive
+						}
+						batch = append(batch, result)
+					default:
+						break drain
+					}
+				}
+				clear(bySource)
+				for _, result := range batch {
+					// Rewrite path as relative
+					if result.Addr != nil {
+						result.Addr.File, _ = strings.CutPrefix(result.Addr.File, path+"/")
+					}
+					for _, line := range result.Context {
+						line.Addr.File, _ = strings.CutPrefix(line.Addr.File, path+"/")
+					}
+					bySource[result.Source] = append(bySource[result.Source], result)
 				}
 
-				result.Score = fuzzy.Match(query, result.Text)
-				// Only show positive scores
-				if result.Score > 0 {
-					heap.Push(&results, result)
+				// Score each source's results with its own profile
+				for src, batch := range bySource {
+					texts = texts[:0]
+					for _, result := range batch {
+						texts = append(texts, result.Text)
+					}
+					matcher := matchers.For(src)
+					scores := matcher.MatchAll(query, texts)
+					edits := make([]int, len(batch))
+					for _, score := range scores {
+						if score > 0 {
+							exact++
+						}
+					}
+					if exact < ApproxThreshold {
+						// Fall back to tolerating typos while exact matches are scarce
+						var missed []int
+						texts = texts[:0]
+						for i, score := range scores {
+							if score == fuzzy.MinScore {
+								missed = append(missed, i)
+								texts = append(texts, batch[i].Text)
+							}
+						}
+						approxScores, approxEdits := matcher.MatchApproxAll(approx, texts)
+						for j, i := range missed {
+							scores[i], edits[i] = approxScores[j], approxEdits[j]
+						}
+					}
+					for i, result := range batch {
+						result.Score, result.Edits = scores[i], edits[i]
+						// Only show positive scores
+						if result.Score > 0 {
+							status(src).Results++
+							results.Insert(result)
+						}
+					}
 				}
 			}
 		}
 	}()
 }
 
+// markClean marks the window clean once a search is complete, so that
+// Del does not warn about it
+func (s *Search) markClean(ctx context.Context) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// A newer search has started
+	if ctx.Err() != nil {
+		return nil
+	}
+	s.complete = true
+	return s.win.Ctl("clean")
+}
+
+// refine rescores the candidates of an earlier search whose query is
+// extended by query, using the same flags. Appending to a query only
+// narrows a fuzzy match, so these can be shown while the sources rerun,
+// though a source filtering by query may no longer return them.
+// Deleting from a query has no such guarantee and reruns from scratch.
+// Called with s.lock held.
+func (s *Search) refine(query string, flags []Flag) []*Result {
+	if len(query) <= len(s.candidatesQuery) || !strings.HasPrefix(query, s.candidatesQuery) ||
+		!slices.Equal(flags, s.candidatesFlags) {
+		return nil
+	}
+	matchers := make(Matchers)
+	var results []*Result
+	for _, candidate := range s.candidates {
+		result := *candidate // the earlier search may still hold candidate
+		result.Score = matchers.For(result.Source).Match(query, result.Text)
+		result.Edits = 0
+		if result.Score > 0 {
+			results = append(results, &result)
+		}
+	}
+	return results
+}
+
+// mergeResults ranks provisional results among those retained, as
+// TopResults would, without letting them displace retained results for
+// good
+func mergeResults(retained, provisional []*Result) []*Result {
+	merged := NewTopResults(MaxRetained, MaxRetainedPerFile)
+	for _, result := range retained {
+		merged.Insert(result)
+	}
+	for _, result := range provisional {
+		merged.Insert(result)
+	}
+	return merged.Sorted()
+}
+
+// keep records rendered results as candidates for refinement
+func (s *Search) keep(ctx context.Context, query string, flags []Flag, results []*Result) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// A newer search has started
+	if ctx.Err() != nil {
+		return
+	}
+	s.candidates = results
+	s.candidatesQuery = query
+	s.candidatesFlags = flags
+}
+
+// Header is the line naming a group's file
+type Header struct {
+	Range  Range
+	More   Range // of the " … N more" suffix, when results are hidden
+	File   string
+	Hidden int // results of the file not shown
+}
+
 type Group struct {
 	Name    string // optional name for group
 	Results []*Result
+	Best    *Result     // highest ranked result
+	Score   fuzzy.Score // best score, plus the score of a matching Name
 }
 
-func (s *Search) writeResults(ctx context.Context, results []*Result) error {
+func (s *Search) writeResults(ctx context.Context, results []*Result, statuses []Status) error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
@@ -414,58 +795,68 @@ func (s *Search) writeResults(ctx context.Context, results []*Result) error {
 		return fmt.Errorf("read addr: %w", err)
 	}
 
-	s.results = make([]*Result, len(results))
-	s.ranges = make([]Range, len(results))
-	var sb strings.Builder
+	s.retained = results
+	s.statuses = statuses
+	var sb runeBuilder
 
 	// Fix query line newline, if deleted
 	if !strings.HasSuffix(s.query, "\n") {
 		s.query += "\n"
 	}
 	sb.WriteString(s.query)
+	if len(statuses) > 0 {
+		fmt.Fprintf(&sb, "%s\n", statusLine(statuses))
+	}
 
-	// TODO: not all results have files
-	var groups []*Group
+	// Show a page of results at a time, and only the best few of a file
+	// until it is expanded, when it shows every result
+	limit := (s.pages + 1) * MaxResults
+	total := make(map[string]int)    // results per file
+	eligible := make(map[string]int) // results per file within the file's limit
+	shown := make(map[string]int)    // results per file within both limits
+	var visible []*Result
+	paged := 0 // results within the file limits, but not the page limit
 	for _, result := range results {
 		if result.Addr == nil {
-			groups = append(groups, &Group{Results: []*Result{result}})
+			if len(visible) < limit {
+				visible = append(visible, result)
+			} else {
+				paged++
+			}
 			continue
 		}
 		file := result.Addr.File
-		for _, group := range groups {
-			if group.Name == file {
-				i, _ := slices.BinarySearchFunc(group.Results, result, func(a *Result, b *Result) int {
-					if a.Addr == nil || b.Addr == nil || a.Addr.FromLine == "" || b.Addr.FromLine == "" {
-						return cmp.Compare(b.Score, a.Score) // higher scores at top
-					}
-					i, _ := strconv.Atoi(a.Addr.FromLine)
-					j, _ := strconv.Atoi(b.Addr.FromLine)
-					return cmp.Compare(i, j) // lower line numbers at top
-				})
-				group.Results = slices.Insert(group.Results, i, result)
-				goto L
-			}
+		total[file]++
+		if !s.expanded[file] && eligible[file] >= MaxResultsPerFile {
+			continue
 		}
-		groups = append(groups, &Group{Name: file, Results: []*Result{result}})
-	L:
+		eligible[file]++
+		if s.expanded[file] || len(visible) < limit {
+			visible = append(visible, result)
+			shown[file]++
+		} else {
+			paged++
+		}
+	}
+	results = visible
+	s.results = make([]*Result, 0, len(results))
+	s.ranges = make([]Range, 0, len(results))
+	s.headers = nil
+	s.more = Range{}
+	hidden := make(map[string]int)
+	for file, n := range total {
+		hidden[file] = n - shown[file]
 	}
 
-	i := 0
-	for _, group := range groups {
-		if group.Name != "" {
-			fmt.Fprintf(&sb, "%s\n", group.Name)
-		}
-		for _, result := range group.Results {
-			s.results[i] = result // place in updated order
-			start := sb.Len() - 1
-			addr := result.Addr
-			if addr != nil && addr.FromLine != "" {
-				fmt.Fprintf(&sb, "%-5s ", addr.FromLine)
-			}
-			fmt.Fprintf(&sb, "%s\n", result.Text)
-			s.ranges[i] = Range{start, sb.Len() - 1}
-			i++
-		}
+	if s.tree {
+		s.writeTree(&sb, results, hidden)
+	} else {
+		s.writeGroups(&sb, results, hidden)
+	}
+	if paged > 0 {
+		start := sb.Runes()
+		fmt.Fprintf(&sb, "… %d more\n", paged)
+		s.more = Range{start, sb.Runes()}
 	}
 	err = s.win.Addr("0,$")
 	if err != nil {
@@ -476,7 +867,8 @@ func (s *Search) writeResults(ctx context.Context, results []*Result) error {
 		return fmt.Errorf("write: %w", err)
 	}
 	// Place the cursor back at the end of the prompt line
-	err = s.win.Addr("#%d,#%d", min(q0, len(s.query)-1), min(q1, len(s.query)-1))
+	end := utf8.RuneCountInString(s.query) - 1
+	err = s.win.Addr("#%d,#%d", min(q0, end), min(q1, end))
 	if err != nil {
 		return fmt.Errorf("addr: %w", err)
 	}
@@ -489,19 +881,205 @@ func (s *Search) writeResults(ctx context.Context, results []*Result) error {
 	if err != nil {
 		return fmt.Errorf("show: %w", err)
 	}
+	// Rewriting the results of a finished search leaves it finished
+	if s.complete {
+		err = s.win.Ctl("clean")
+		if err != nil {
+			return fmt.Errorf("clean: %w", err)
+		}
+	}
 	return nil
 }
 
+// writeGroups writes results grouped by file, under a header naming it.
+// Called with s.lock held.
+func (s *Search) writeGroups(sb *runeBuilder, results []*Result, hidden map[string]int) {
+	// TODO: not all results have files
+	var groups []*Group
+	for _, result := range results {
+		if result.Addr == nil {
+			groups = append(groups, &Group{Results: []*Result{result}})
+			continue
+		}
+		file := result.Addr.File
+		for _, group := range groups {
+			if group.Name == file {
+				i, _ := slices.BinarySearchFunc(group.Results, result, compareLines)
+				group.Results = slices.Insert(group.Results, i, result)
+				goto L
+			}
+		}
+		groups = append(groups, &Group{Name: file, Results: []*Result{result}})
+	L:
+	}
+
+	// Results arrive best first, then rank groups of a file by its path as
+	// well, so that matches in a file named like the query rise
+	paths := fuzzy.NewMatcher(fuzzy.PathOptions)
+	query := s.Query()
+	for _, group := range groups {
+		group.Best = slices.MaxFunc(group.Results, (*Result).Compare)
+		group.Score = group.Best.Score
+		if group.Name != "" {
+			group.Score += max(paths.Match(query, group.Name), 0)
+		}
+	}
+	slices.SortStableFunc(groups, func(a, b *Group) int {
+		if c := cmp.Compare(a.Best.Edits, b.Best.Edits); c != 0 {
+			return c
+		}
+		if c := cmp.Compare(b.Score, a.Score); c != 0 {
+			return c
+		}
+		return b.Best.Compare(a.Best)
+	})
+
+	for _, group := range groups {
+		if group.Name != "" {
+			s.writeHeader(sb, group.Name, "", group.Name, hidden[group.Name])
+		}
+		s.writeLines(sb, group.Results, "")
+	}
+}
+
+// writeLines writes results within a file, by line, each among its
+// context lines. Called with s.lock held.
+func (s *Search) writeLines(sb *runeBuilder, results []*Result, indent string) {
+	written := 0 // last line written, context shared by results appears once
+	for _, result := range results {
+		line := lineOf(result)
+		for _, context := range result.Context {
+			if n := lineOf(context); n < line && n > written {
+				s.writeContext(sb, context, indent)
+				written = n
+			}
+		}
+		s.writeResult(sb, result, indent, result.Text)
+		written = max(written, line)
+		for _, context := range result.Context {
+			if n := lineOf(context); n > line && n > written {
+				s.writeContext(sb, context, indent)
+				written = n
+			}
+		}
+	}
+}
+
+// writeContext writes a line of context, marked like grep -C marks them,
+// and records its range. Called with s.lock held.
+func (s *Search) writeContext(sb *runeBuilder, context *Result, indent string) {
+	start := sb.Runes()
+	fmt.Fprintf(sb, "%s%-5s %s\n", indent, context.Addr.FromLine+"-", context.Text)
+	s.results = append(s.results, context)
+	s.ranges = append(s.ranges, Range{start, sb.Runes()})
+}
+
+func lineOf(result *Result) int {
+	if result.Addr == nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(result.Addr.FromLine)
+	return n
+}
+
+// compareLines orders results within a file by line
+func compareLines(a *Result, b *Result) int {
+	if a.Addr == nil || b.Addr == nil || a.Addr.FromLine == "" || b.Addr.FromLine == "" {
+		return cmp.Compare(b.Score, a.Score) // higher scores at top
+	}
+	i, _ := strconv.Atoi(a.Addr.FromLine)
+	j, _ := strconv.Atoi(b.Addr.FromLine)
+	return cmp.Compare(i, j) // lower line numbers at top
+}
+
+// writeHeader writes the header of a file's results, as label. Called
+// with s.lock held.
+func (s *Search) writeHeader(sb *runeBuilder, file, indent, label string, hidden int) {
+	start := sb.Runes()
+	fmt.Fprintf(sb, "%s%s", indent, label)
+	var more Range
+	if hidden > 0 {
+		more.Start = sb.Runes()
+		fmt.Fprintf(sb, " … %d more", hidden)
+		more.End = sb.Runes()
+	}
+	fmt.Fprintf(sb, "\n")
+	s.headers = append(s.headers, Header{Range{start, sb.Runes()}, more, file, hidden})
+}
+
+// writeResult writes a result's line, showing text, and records its
+// range. Called with s.lock held.
+func (s *Search) writeResult(sb *runeBuilder, result *Result, indent, text string) {
+	start := sb.Runes()
+	if s.marked[markKey(result)] {
+		sb.WriteString("* ")
+	}
+	sb.WriteString(indent)
+	addr := result.Addr
+	if addr != nil && addr.FromLine != "" {
+		fmt.Fprintf(sb, "%-5s ", addr.FromLine)
+	}
+	fmt.Fprintf(sb, "%s\n", text)
+	if s.explain {
+		fmt.Fprintf(sb, "%s\t%s\n", indent, s.explanation(result))
+	}
+	s.results = append(s.results, result)
+	s.ranges = append(s.ranges, Range{start, sb.Runes()})
+}
+
+// edit keeps the ranges of what is shown in step with an edit to the
+// window, forgetting those of lines it splits or joins, so that a Look
+// never acts on a line other than the one clicked. Called with s.lock held.
+func (s *Search) edit(q0, q1, n int, nl bool) {
+	j := 0
+	for i, r := range s.ranges {
+		if r, ok := r.Edit(q0, q1, n, nl); ok {
+			s.ranges[j], s.results[j] = r, s.results[i]
+			j++
+		}
+	}
+	clear(s.results[j:])
+	s.ranges, s.results = s.ranges[:j], s.results[:j]
+
+	headers := s.headers[:0]
+	for _, h := range s.headers {
+		var ok bool
+		if h.Range, ok = h.Range.Edit(q0, q1, n, nl); !ok {
+			continue
+		}
+		if h.More, ok = h.More.Edit(q0, q1, n, nl); !ok {
+			h.Hidden = 0 // plumb the file instead
+		}
+		headers = append(headers, h)
+	}
+	s.headers = headers
+	if s.more.End > 0 {
+		s.more, _ = s.more.Edit(q0, q1, n, nl)
+	}
+}
+
 func (s *Search) insert(ctx context.Context, q0, q1 int, text string) error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
+	// Acme omits the text of long insertions, such as a large paste
+	omitted := utf8.RuneCountInString(text) != q1-q0
+	s.edit(q0, q0, q1-q0, omitted || strings.Contains(text, "\n"))
 	// If an edit occurs after the query line
-	if q0 > len(s.query) {
-		// TODO: Update s.ranges
+	query := []rune(s.query) // Acme offsets count runes
+	if q0 > len(query) {
 		return nil
 	}
+	if omitted {
+		var err error
+		text, err = s.readBody(q0, q1)
+		if err != nil {
+			return err
+		}
+	}
 	// Insert within query line
-	s.query = s.query[:q0] + text + s.query[q0:]
+	s.query = string(query[:q0]) + text + string(query[q0:])
+	s.resetPaging()
+	s.confirm = "" // confirmed for results since replaced
 
 	if s.cancel != nil {
 		s.cancel() // Cancel previous search
@@ -515,18 +1093,21 @@ func (s *Search) insert(ctx context.Context, q0, q1 int, text string) error {
 func (s *Search) delete(ctx context.Context, q0, q1 int) error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
+	s.edit(q0, q1, 0, false)
 	// Deletion which starts after the query line
-	if q0 > len(s.query) {
-		// TODO: Update s.ranges
+	query := []rune(s.query) // Acme offsets count runes
+	if q0 > len(query) {
 		return nil
 	}
-	if q1 > len(s.query) {
+	if q1 > len(query) {
 		// Update delete to end at end of query
-		q1 = len(s.query)
+		q1 = len(query)
 	}
 
 	// Delete within query line
-	s.query = s.query[:q0] + s.query[q1:]
+	s.query = string(query[:q0]) + string(query[q1:])
+	s.resetPaging()
+	s.confirm = "" // confirmed for results since replaced
 
 	if s.cancel != nil {
 		s.cancel() // Cancel previous search
@@ -537,28 +1118,87 @@ func (s *Search) delete(ctx context.Context, q0, q1 int) error {
 	return nil
 }
 
-func (s *Search) Plumb(q0 int) (bool, error) {
-	// TODO: right clicking the very beginning of the first line fails to plumb
-	if len(s.ranges) == 0 || q0 < s.ranges[0].Start {
+// readBody reads the runes [q0, q1) of the window's body. Called with
+// s.lock held, as rendering sets addr too.
+func (s *Search) readBody(q0, q1 int) (string, error) {
+	err := s.win.Addr("#%d,#%d", q0, q1)
+	if err != nil {
+		return "", fmt.Errorf("addr: %w", err)
+	}
+	data, err := s.win.ReadAll("xdata")
+	if err != nil {
+		return "", fmt.Errorf("read xdata: %w", err)
+	}
+	return string(data), nil
+}
+
+// resetPaging shows only the first page of a new search's results.
+// Called with s.lock held.
+func (s *Search) resetPaging() {
+	s.pages = 0
+	s.expanded = nil
+}
+
+// Look acts on a click within the results: plumbing or previewing a
+// result, showing more results, or expanding a file's results
+func (s *Search) Look(ctx context.Context, q0 int) (bool, error) {
+	s.lock.Lock()
+	more := s.more.End > 0 && s.more.Compare(q0) == 0
+	var header *Header
+	for i := range s.headers {
+		if s.headers[i].Range.Compare(q0) == 0 {
+			header = &s.headers[i]
+		}
+	}
+	result := s.resultAt(q0)
+	preview := s.preview
+	s.lock.Unlock()
+
+	switch {
+	case more:
+		return true, s.More(ctx)
+	case header != nil && header.Hidden > 0 && header.More.Compare(q0) == 0:
+		return true, s.Expand(ctx, header.File)
+	case header != nil:
+		// Open the file at its top
+		result = &Result{Text: header.File, Addr: &Addr{File: header.File}}
+	}
+
+	switch {
+	case result == nil:
 		return false, nil
+	case preview:
+		return s.showPreview(result)
+	}
+	return s.Plumb(result)
+}
+
+// resultAt finds the result whose line holds q0. Called with s.lock held.
+func (s *Search) resultAt(q0 int) *Result {
+	if len(s.ranges) == 0 || q0 < s.ranges[0].Start {
+		return nil
 	}
 
 	i, found := slices.BinarySearchFunc(s.ranges, q0, func(r Range, q0 int) int { return r.Compare(q0) })
 	if !found {
-		return false, nil
+		return nil
 	}
+	return s.results[i]
+}
 
-	addr := s.results[i].Addr
-	if addr == nil {
+func (s *Search) Plumb(result *Result) (bool, error) {
+	target, ok := plumbTarget(result)
+	if !ok {
 		return false, nil
 	}
+	return true, s.plumb(target)
+}
 
-	cmd := exec.Command("plumb", addr.String())
-	err := cmd.Run()
-	if err != nil {
-		return true, fmt.Errorf("plumb: %w", err)
-	}
-	return true, nil
+// inResults reports whether q0 falls below the query line
+func (s *Search) inResults(q0 int) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return q0 >= utf8.RuneCountInString(s.query)
 }
 
 func (s *Search) EventLoop(ctx context.Context) error {
@@ -575,12 +1215,28 @@ func (s *Search) EventLoop(ctx context.Context) error {
 			switch e.C2 {
 			// Unblock standard window operations
 			case 'x', 'X':
-				s.win.WriteEvent(e)
+				// Button-2 on a result marks it, see Mark
+				if e.C2 == 'X' && s.inResults(e.OrigQ0) {
+					ok, err := s.MarkAt(ctx, e.OrigQ0)
+					if err != nil {
+						s.win.Errf("mark: %v", err)
+					}
+					if ok {
+						break
+					}
+				}
+				ok, err := s.Execute(ctx, string(e.Text))
+				if err != nil {
+					s.win.Errf("%s: %v", strings.TrimSpace(string(e.Text)), err)
+				}
+				if !ok {
+					s.win.WriteEvent(e)
+				}
 			case 'l', 'L': // look
-				if e.OrigQ0 > len(s.query) {
-					ok, err := s.Plumb(e.OrigQ0)
+				if s.inResults(e.OrigQ0) {
+					ok, err := s.Look(ctx, e.OrigQ0)
 					if err != nil {
-						return err
+						s.win.Errf("look: %v", err)
 					}
 					if !ok {
 						s.win.WriteEvent(e)
@@ -590,7 +1246,7 @@ func (s *Search) EventLoop(ctx context.Context) error {
 				s.win.WriteEvent(e)
 			default:
 				switch e.C1 {
-				case 'K':
+				case 'K', 'M': // typed, or cut, pasted and undone with the mouse
 					// Ignore tag events
 					if unicode.IsLower(e.C2) {
 						continue
@@ -622,12 +1278,12 @@ func (s *Search) WritePrompt() error {
 	s.query = line
 	_, err := s.win.Write("body", []byte(line))
 	if err != nil {
-		fmt.Errorf("write: %w", err)
+		return fmt.Errorf("write: %w", err)
 	}
 	s.query = line
 	err = s.win.Addr("#2")
 	if err != nil {
-		fmt.Errorf("addr: %w", err)
+		return fmt.Errorf("addr: %w", err)
 	}
 	err = s.win.Ctl("dot=addr")
 	if err != nil {
@@ -663,6 +1319,12 @@ func main() {
 		return
 	}
 
+	err = win.Fprintf("tag", " Explain More Tree Preview OpenAll OpenFiles Mark")
+	if err != nil {
+		log.Printf("write tag: %v", err)
+		return
+	}
+
 	s := &Search{prompt: "> ", win: win}
 	s.WritePrompt()
 	if err != nil {
@@ -671,6 +1333,7 @@ func main() {
 	}
 
 	defer cancel()
+	defer s.closePreview()
 	err = s.EventLoop(ctx)
 	if err != nil {
 		log.Printf("new acme win: %v", err)
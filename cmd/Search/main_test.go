@@ -0,0 +1,139 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestAddrString(t *testing.T) {
+	tests := []struct {
+		name string
+		addr Addr
+		want string
+	}{
+		{"file", Addr{File: "a.go"}, "a.go"},
+		{"line", Addr{File: "a.go", FromLine: "3"}, "a.go:3"},
+		{"column", Addr{File: "a.go", FromLine: "3", FromColumn: "5"}, "a.go:3-#0+#4"},
+		{"first column", Addr{File: "a.go", FromLine: "3", FromColumn: "1"}, "a.go:3-#0+#0"},
+		{"range", Addr{File: "a.go", FromLine: "3", FromColumn: "5", ToLine: "4", ToColumn: "2"}, "a.go:3-#0+#4,4-#0+#1"},
+		{"range of lines", Addr{File: "a.go", FromLine: "3", ToLine: "4"}, "a.go:3,4"},
+		{"invalid column", Addr{File: "a.go", FromLine: "3", FromColumn: "x"}, "a.go:3"},
+		{"zero column", Addr{File: "a.go", FromLine: "3", FromColumn: "0"}, "a.go:3"},
+		{"invalid range columns", Addr{File: "a.go", FromLine: "3", FromColumn: "-1", ToLine: "4", ToColumn: "y"}, "a.go:3,4"},
+		{"no line", Addr{File: "a.go", FromColumn: "5", ToLine: "4"}, "a.go"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.addr.String(); got != tt.want {
+				t.Errorf("%+v.String() = %q, want %q", tt.addr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRangeEdit(t *testing.T) {
+	r := Range{10, 20} // a line, its newline at 19
+	tests := []struct {
+		name   string
+		q0, q1 int
+		n      int
+		nl     bool
+		want   Range
+		ok     bool
+	}{
+		{"before", 2, 4, 5, false, Range{13, 23}, true},
+		{"line inserted before", 2, 2, 3, true, Range{13, 23}, true},
+		{"deleted up to its start", 5, 10, 0, false, Range{5, 15}, true},
+		{"inserted at its start", 10, 10, 3, false, Range{10, 23}, true},
+		{"newline inserted at its start", 10, 10, 1, true, Range{}, false},
+		{"inside", 12, 15, 1, false, Range{10, 18}, true},
+		{"newline inserted inside", 12, 12, 1, true, Range{}, false},
+		{"across its newline", 18, 22, 0, false, Range{}, false},
+		{"its newline deleted", 19, 20, 0, false, Range{}, false},
+		{"across the whole line", 5, 25, 2, false, Range{}, false},
+		{"after", 20, 25, 0, false, Range{10, 20}, true},
+		{"line inserted after", 20, 20, 3, true, Range{10, 20}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := r.Edit(tt.q0, tt.q1, tt.n, tt.nl)
+			if ok != tt.ok || (ok && got != tt.want) {
+				t.Errorf("%v.Edit(%d, %d, %d, %v) = %v, %v, want %v, %v", r, tt.q0, tt.q1, tt.n, tt.nl, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestSearchEdit(t *testing.T) {
+	results := []*Result{{Text: "a"}, {Text: "b"}, {Text: "c"}}
+	tests := []struct {
+		name   string
+		q0, q1 int
+		n      int
+		nl     bool
+		want   []*Result
+		ranges []Range
+	}{
+		{"before", 0, 0, 2, false, results, []Range{{12, 22}, {22, 32}, {32, 42}}},
+		{"inside the first", 12, 14, 0, false, results, []Range{{10, 18}, {18, 28}, {28, 38}}},
+		{"across the second's newline", 28, 32, 0, false, results[:1], []Range{{10, 20}}},
+		{"lines inserted at the second's start", 20, 20, 5, true, []*Result{results[0], results[2]}, []Range{{10, 20}, {35, 45}}},
+		{"after", 40, 40, 3, true, results, []Range{{10, 20}, {20, 30}, {30, 40}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Search{
+				results: slices.Clone(results),
+				ranges:  []Range{{10, 20}, {20, 30}, {30, 40}},
+				headers: []Header{{Range: Range{0, 10}, More: Range{5, 9}, File: "a.go", Hidden: 2}},
+			}
+			s.edit(tt.q0, tt.q1, tt.n, tt.nl)
+			if !slices.Equal(s.results, tt.want) || !slices.Equal(s.ranges, tt.ranges) {
+				t.Errorf("edit(%d, %d, %d, %v) left %v at %v, want %v at %v", tt.q0, tt.q1, tt.n, tt.nl, s.results, s.ranges, tt.want, tt.ranges)
+			}
+			if len(s.headers) != 1 || s.headers[0].Hidden != 2 {
+				t.Errorf("header %+v changed by an edit sparing its suffix", s.headers)
+			}
+		})
+	}
+
+	// A header whose " … N more" suffix is split plumbs its file instead
+	s := &Search{headers: []Header{{Range: Range{0, 10}, More: Range{5, 9}, File: "a.go", Hidden: 2}}}
+	s.edit(6, 6, 1, true)
+	if len(s.headers) != 0 {
+		t.Errorf("header %+v kept across a split line", s.headers)
+	}
+	s = &Search{headers: []Header{{Range: Range{0, 10}, More: Range{5, 9}, File: "a.go", Hidden: 2}}}
+	s.edit(4, 6, 0, false)
+	if len(s.headers) != 1 || s.headers[0].Hidden != 0 || s.headers[0].Range != (Range{0, 8}) {
+		t.Errorf("header %+v, want its suffix forgotten", s.headers)
+	}
+}
+
+func TestLastLine(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []string
+		want   string
+	}{
+		{"none", nil, ""},
+		{"one line", []string{"rg: regex parse error\n"}, "rg: regex parse error"},
+		{"last of many", []string{"a: Permission denied\nb: Permission denied\n", "c: Permission denied\n"}, "c: Permission denied"},
+		{"split across writes", []string{"first\nsec", "ond\n"}, "second"},
+		{"unterminated", []string{"first\nsecond"}, "second"},
+		{"trailing blank lines", []string{"error\n\n  \n"}, "error"},
+		{"long", []string{strings.Repeat("x", 2*MaxLineLength) + "\n"}, strings.Repeat("x", MaxLineLength)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var l lastLine
+			for _, w := range tt.writes {
+				l.Write([]byte(w))
+			}
+			if got := l.String(); got != tt.want {
+				t.Errorf("last line %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
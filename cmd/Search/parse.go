@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// MaxAddrLength bounds the address prefix kept ahead of a line's text
+const MaxAddrLength = 4096
+
+// Format of a command source's output
+type Format int
+
+const (
+	FormatGuess   Format = iota // addresses guessed from e.g. `file:line.col,line.col: text`, as from L sym
+	FormatPlain                 // `file:line:text` or `file:line:col:text`, as from grep -n
+	FormatVimgrep               // `file:line:col:text`, as from rg --vimgrep
+	FormatJSON                  // JSON Lines, as from rg --json
+	FormatPaths                 // a file path per line, as from rg --files
+)
+
+var twoColonRangeRegexp = regexp.MustCompile(`(.*):([0-9]+).([0-9]+)[:,]([0-9]+).([0-9]+)[: ](.*)`)
+var twoColonAddrRegexp = regexp.MustCompile(`(.*):([0-9]+)[:,]([0-9]+)[: ](.*)`)
+
+// Paths are matched lazily, text is more likely than a path to contain `:1:`
+var plainRegexp = regexp.MustCompile(`^(.+?):([0-9]+):(?:([0-9]+):)?(.*)$`)
+var vimgrepRegexp = regexp.MustCompile(`^(.+?):([0-9]+):([0-9]+):(.*)$`)
+
+// Parser reads results from command output in a Format
+type Parser struct {
+	format Format
+	br     *bufio.Reader
+	dec    *json.Decoder
+
+	// Context lines of rg --json output follow the match they come after
+	// and precede the match they come before, so a match is held until
+	// the lines after it are read
+	pending    *Result
+	pendingEnd int       // last line of pending, or of its context
+	before     []*Result // contiguous context lines, for the next match
+	beforeEnd  int       // last line of before
+}
+
+func NewParser(format Format, r io.Reader) *Parser {
+	p := &Parser{format: format}
+	if format == FormatJSON {
+		// Messages are decoded whole, as rg --json ignores --max-columns,
+		// their text truncated once decoded
+		p.dec = json.NewDecoder(r)
+	} else {
+		p.br = bufio.NewReader(r)
+	}
+	return p
+}
+
+// Next returns the next result, or io.EOF at the end of output
+func (p *Parser) Next() (*Result, error) {
+	if p.format == FormatJSON {
+		return p.nextJSON()
+	}
+
+	line, truncated, err := readLine(p.br, MaxAddrLength+MaxLineLength)
+	if err != nil {
+		return nil, err
+	}
+	var res Result
+	switch p.format {
+	case FormatPlain:
+		res = parseColumns(plainRegexp, line)
+	case FormatVimgrep:
+		res = parseColumns(vimgrepRegexp, line)
+	case FormatPaths:
+		res = Result{Text: line}
+	default:
+		res = parseLine(line)
+	}
+	res.Text = truncateText(res.Text, truncated)
+	return &res, nil
+}
+
+// readLine reads a line of any length without its newline or carriage
+// return, keeping at most limit bytes and reporting whether the rest was
+// discarded.
+func readLine(r *bufio.Reader, limit int) (string, bool, error) {
+	var line []byte
+	truncated := false
+	for {
+		chunk, err := r.ReadSlice('\n')
+		text := bytes.TrimSuffix(chunk, []byte{'\n'})
+		n := min(len(text), limit-len(line))
+		line = append(line, text[:n]...)
+		truncated = truncated || n < len(text)
+
+		switch {
+		case errors.Is(err, bufio.ErrBufferFull):
+			continue // line continues past the buffer
+		case errors.Is(err, io.EOF) && (len(chunk) > 0 || len(line) > 0 || truncated):
+			// Final line lacks a newline
+		case err != nil:
+			return "", false, err
+		}
+		return string(bytes.TrimSuffix(line, []byte{'\r'})), truncated, nil
+	}
+}
+
+// parseLine parses a line of output, with an optional address prefix
+func parseLine(line string) Result {
+	var res Result
+	if matches := twoColonRangeRegexp.FindStringSubmatch(line); matches != nil {
+		res.Addr = &Addr{
+			File:       matches[1],
+			FromLine:   matches[2],
+			FromColumn: matches[3],
+			ToLine:     matches[4],
+			ToColumn:   matches[5],
+		}
+		res.Text = matches[6]
+	} else if matches := twoColonAddrRegexp.FindStringSubmatch(line); matches != nil {
+		res.Addr = &Addr{
+			File:       matches[1],
+			FromLine:   matches[2],
+			FromColumn: matches[3],
+		}
+		res.Text = matches[4]
+	} else {
+		res.Text = line
+	}
+	return res
+}
+
+// parseColumns parses a line matched by plainRegexp or vimgrepRegexp,
+// whose columns count bytes from 1.
+func parseColumns(re *regexp.Regexp, line string) Result {
+	matches := re.FindStringSubmatch(line)
+	if matches == nil {
+		return Result{Text: line}
+	}
+	res := Result{
+		Addr: &Addr{File: matches[1], FromLine: matches[2]},
+		Text: matches[4],
+	}
+	if col, err := strconv.Atoi(matches[3]); err == nil && col > 0 {
+		res.Addr.FromColumn = strconv.Itoa(runeColumn(res.Text, col-1))
+	}
+	return res
+}
+
+// runeColumn converts a byte offset within text to a column, counting
+// runes from 1 as Acme does.
+func runeColumn(text string, offset int) int {
+	offset = min(max(offset, 0), len(text))
+	return utf8.RuneCountInString(text[:offset]) + 1
+}
+
+// rgMessage is a message of rg --json output, see
+// https://docs.rs/grep-printer/latest/grep_printer/struct.JSON.html
+type rgMessage struct {
+	Type string `json:"type"`
+	Data struct {
+		Path       rgData `json:"path"`
+		Lines      rgData `json:"lines"`
+		LineNumber int    `json:"line_number"`
+		Submatches []struct {
+			Match rgData `json:"match"`
+			Start int    `json:"start"`
+			End   int    `json:"end"`
+		} `json:"submatches"`
+	} `json:"data"`
+}
+
+// rgData holds text, or base64 encoded bytes when not valid UTF-8
+type rgData struct {
+	Text  *string `json:"text"`
+	Bytes []byte  `json:"bytes"`
+}
+
+func (d rgData) String() string {
+	if d.Text != nil {
+		return *d.Text
+	}
+	return string(d.Bytes)
+}
+
+func (p *Parser) nextJSON() (*Result, error) {
+	for {
+		var msg rgMessage
+		err := p.dec.Decode(&msg)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				if res := p.flush(); res != nil {
+					return res, nil
+				}
+				return nil, err
+			}
+			return nil, fmt.Errorf("decode: %w", err)
+		}
+
+		switch msg.Type {
+		case "context":
+			n := msg.Data.LineNumber
+			res := &Result{
+				Addr: &Addr{File: msg.Data.Path.String(), FromLine: strconv.Itoa(n)},
+				Text: truncateText(strings.TrimRight(msg.Data.Lines.String(), "\r\n"), false),
+			}
+			if len(p.before) > 0 && n != p.beforeEnd+1 {
+				p.before = nil
+			}
+			p.before, p.beforeEnd = append(p.before, res), n
+			if p.pending != nil {
+				if n == p.pendingEnd+1 {
+					p.pending.Context = append(p.pending.Context, res)
+					p.pendingEnd = n
+				} else {
+					return p.flush(), nil
+				}
+			}
+		case "match":
+			res, end := matchResult(msg)
+			if len(p.before) > 0 && p.beforeEnd == msg.Data.LineNumber-1 {
+				res.Context = p.before
+			}
+			p.before = nil
+			prev := p.flush()
+			p.pending, p.pendingEnd = res, end
+			if prev != nil {
+				return prev, nil
+			}
+		case "end":
+			p.before = nil
+			if res := p.flush(); res != nil {
+				return res, nil
+			}
+		}
+	}
+}
+
+// flush returns the held match, if any
+func (p *Parser) flush() *Result {
+	res := p.pending
+	p.pending = nil
+	return res
+}
+
+// matchResult converts a match message to a result, along with the last
+// line it spans
+func matchResult(msg rgMessage) (*Result, int) {
+	lines := msg.Data.Lines.String()
+	text := strings.TrimRight(lines, "\r\n")
+	res := &Result{
+		Addr: &Addr{File: msg.Data.Path.String()},
+		Text: truncateText(text, false),
+	}
+	end := msg.Data.LineNumber
+	for i, sub := range msg.Data.Submatches {
+		if i == 0 && msg.Data.LineNumber > 0 {
+			// Select the first match, which may span lines with rg -U
+			line, column := lineColumn(lines, msg.Data.LineNumber, sub.Start)
+			res.Addr.FromLine, res.Addr.FromColumn = strconv.Itoa(line), strconv.Itoa(column)
+			line, column = lineColumn(lines, msg.Data.LineNumber, sub.End)
+			res.Addr.ToLine, res.Addr.ToColumn = strconv.Itoa(line), strconv.Itoa(column)
+		}
+		// Highlight only what survived truncation
+		if sub.End <= len(res.Text) {
+			res.Matches = append(res.Matches, Range{sub.Start, sub.End})
+		}
+	}
+	if res.Addr.FromLine == "" && msg.Data.LineNumber > 0 {
+		res.Addr.FromLine = strconv.Itoa(msg.Data.LineNumber)
+	}
+	if msg.Data.LineNumber > 0 {
+		end += strings.Count(text, "\n")
+	}
+	return res, end
+}
+
+// lineColumn converts a byte offset within lines, the first of which is
+// line, to a line and column.
+func lineColumn(lines string, line, offset int) (int, int) {
+	before := lines[:min(max(offset, 0), len(lines))]
+	if i := strings.LastIndexByte(before, '\n'); i >= 0 {
+		return line + strings.Count(before, "\n"), utf8.RuneCountInString(before[i+1:]) + 1
+	}
+	return line, utf8.RuneCountInString(before) + 1
+}
+
+// truncateText shortens text to at most MaxLineLength bytes, on a rune
+// boundary, marking with an ellipsis text that was cut short here or
+// while reading.
+func truncateText(text string, truncated bool) string {
+	if len(text) <= MaxLineLength && !truncated {
+		return text
+	}
+	n := min(len(text), MaxLineLength)
+	for n > 0 && n < len(text) && !utf8.RuneStart(text[n]) {
+		n--
+	}
+	return text[:n] + "…"
+}
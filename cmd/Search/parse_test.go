@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// parseAll reads every result of output in format
+func parseAll(t *testing.T, format Format, output string) []*Result {
+	t.Helper()
+	p := NewParser(format, strings.NewReader(output))
+	var results []*Result
+	for {
+		res, err := p.Next()
+		if errors.Is(err, io.EOF) {
+			return results
+		}
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		results = append(results, res)
+	}
+}
+
+func TestParseLongLine(t *testing.T) {
+	// Longer than both MaxLineLength and the bufio buffer
+	long := strings.Repeat("x", 3*4096)
+	results := parseAll(t, FormatGuess, "a.go:3:4 "+long+"\nb.go:5:6 short\n")
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2", len(results))
+	}
+	if want := strings.Repeat("x", MaxLineLength) + "…"; results[0].Text != want {
+		t.Errorf("text of %d bytes, want %d", len(results[0].Text), len(want))
+	}
+	if addr := results[1].Addr; addr == nil || addr.File != "b.go" || results[1].Text != "short" {
+		t.Errorf("line after a long line parsed as %+v", results[1])
+	}
+}
+
+func TestParseFinalLine(t *testing.T) {
+	results := parseAll(t, FormatPaths, "a.go\nb.go")
+	if len(results) != 2 || results[0].Text != "a.go" || results[1].Text != "b.go" {
+		t.Errorf("got %v, want a.go and b.go", results)
+	}
+}
+
+func TestParseCRLF(t *testing.T) {
+	results := parseAll(t, FormatGuess, "a.go:1:2 foo\r\n")
+	if len(results) != 1 || results[0].Text != "foo" {
+		t.Errorf("got %+v, want text foo", results[0])
+	}
+	results = parseAll(t, FormatPaths, "dir/b.go\r\n")
+	if len(results) != 1 || results[0].Text != "dir/b.go" {
+		t.Errorf("got %+v, want text dir/b.go", results[0])
+	}
+}
+
+func TestTruncateRuneBoundary(t *testing.T) {
+	// A two byte rune straddles MaxLineLength
+	line := "x" + strings.Repeat("é", MaxLineLength)
+	results := parseAll(t, FormatPaths, line+"\n")
+	text := results[0].Text
+	if !utf8.ValidString(text) {
+		t.Errorf("truncated text is not valid UTF-8")
+	}
+	if !strings.HasSuffix(text, "…") || len(text)-len("…") > MaxLineLength {
+		t.Errorf("text of %d bytes not truncated to %d", len(text), MaxLineLength)
+	}
+	if want := MaxLineLength - 1; len(text)-len("…") != want {
+		t.Errorf("kept %d bytes, want %d", len(text)-len("…"), want)
+	}
+}
+
+// rgMatch is a match message of rg --json output for text at line of
+// a.go, matching from start to end
+func rgMatch(line int, text string, start, end int) string {
+	return fmt.Sprintf(`{"type":"match","data":{"path":{"text":"a.go"},"lines":{"text":%q},"line_number":%d,"submatches":[{"match":{"text":%q},"start":%d,"end":%d}]}}`+"\n",
+		text+"\n", line, text[start:end], start, end)
+}
+
+// rgContext is a context message of rg --json output for text at line
+// of a.go
+func rgContext(line int, text string) string {
+	return fmt.Sprintf(`{"type":"context","data":{"path":{"text":"a.go"},"lines":{"text":%q},"line_number":%d,"submatches":[]}}`+"\n",
+		text+"\n", line)
+}
+
+func TestParseJSON(t *testing.T) {
+	output := rgContext(1, "before") + rgMatch(2, "héllo wörld", 7, 13) + rgContext(3, "after") +
+		`{"type":"end","data":{"path":{"text":"a.go"}}}` + "\n"
+	results := parseAll(t, FormatJSON, output)
+	if len(results) != 1 {
+		t.Fatalf("got %d results, want 1", len(results))
+	}
+	res := results[0]
+	want := Addr{File: "a.go", FromLine: "2", FromColumn: "7", ToLine: "2", ToColumn: "12"}
+	if res.Addr == nil || *res.Addr != want {
+		t.Errorf("address %+v, want %+v", res.Addr, want)
+	}
+	if res.Text != "héllo wörld" || len(res.Matches) != 1 || res.Matches[0] != (Range{7, 13}) {
+		t.Errorf("text %q with matches %v, want wörld matched", res.Text, res.Matches)
+	}
+	if len(res.Context) != 2 || res.Context[0].Text != "before" || res.Context[1].Text != "after" {
+		t.Errorf("context %v, want the lines before and after", res.Context)
+	}
+}
+
+func TestParseLongJSON(t *testing.T) {
+	// rg --json ignores --max-columns, a minified line arrives whole
+	long := strings.Repeat("x", 64*1024) + "needle"
+	results := parseAll(t, FormatJSON, rgMatch(1, long, len(long)-6, len(long))+rgMatch(2, "short", 0, 1))
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2", len(results))
+	}
+	if want := strings.Repeat("x", MaxLineLength) + "…"; results[0].Text != want {
+		t.Errorf("text of %d bytes, want %d", len(results[0].Text), len(want))
+	}
+	if addr := results[0].Addr; addr == nil || addr.FromColumn != strconv.Itoa(64*1024+1) {
+		t.Errorf("address %+v, want the match past the truncation", addr)
+	}
+	if len(results[0].Matches) != 0 {
+		t.Errorf("matches %v, want none within the truncated text", results[0].Matches)
+	}
+}
+
+func TestParsePlain(t *testing.T) {
+	tests := []struct {
+		line string
+		addr Addr
+		text string
+	}{
+		{"a.go:3:text", Addr{File: "a.go", FromLine: "3"}, "text"},
+		{"a.go:3:5:text", Addr{File: "a.go", FromLine: "3", FromColumn: "5"}, "text"},
+		{"a.go:3:x := m[:12:]", Addr{File: "a.go", FromLine: "3"}, "x := m[:12:]"},
+		{"a.go:3:4:héllo", Addr{File: "a.go", FromLine: "3", FromColumn: "3"}, "héllo"}, // byte column 4 is rune 3
+	}
+	for _, tt := range tests {
+		results := parseAll(t, FormatPlain, tt.line+"\n")
+		if len(results) != 1 || results[0].Addr == nil || *results[0].Addr != tt.addr || results[0].Text != tt.text {
+			t.Errorf("%q parsed as %+v, want %+v %q", tt.line, results[0], tt.addr, tt.text)
+		}
+	}
+}
+
+func TestParseVimgrep(t *testing.T) {
+	tests := []struct {
+		line string
+		addr *Addr
+		text string
+	}{
+		{"a.go:3:5:text", &Addr{File: "a.go", FromLine: "3", FromColumn: "5"}, "text"},
+		{"a.go:3:1:x:1:2:", &Addr{File: "a.go", FromLine: "3", FromColumn: "1"}, "x:1:2:"},
+		{"dir/日本.go:1:8:日本 語", &Addr{File: "dir/日本.go", FromLine: "1", FromColumn: "4"}, "日本 語"},
+		{"no address", nil, "no address"},
+	}
+	for _, tt := range tests {
+		results := parseAll(t, FormatVimgrep, tt.line+"\n")
+		res := results[0]
+		if (res.Addr == nil) != (tt.addr == nil) || (tt.addr != nil && *res.Addr != *tt.addr) || res.Text != tt.text {
+			t.Errorf("%q parsed as %+v %q, want %+v %q", tt.line, res.Addr, res.Text, tt.addr, tt.text)
+		}
+	}
+}
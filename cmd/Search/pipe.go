@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Pipe runs command with the results selected as its input, one per line
+// as file:line.col: text, showing its output in a new +Pipe window
+func (s *Search) Pipe(ctx context.Context, command string) error {
+	command = strings.TrimSpace(command)
+	if command == "" {
+		return fmt.Errorf("no command")
+	}
+
+	s.lock.Lock()
+	var sb strings.Builder
+	for _, result := range s.selected() {
+		fmt.Fprintf(&sb, "%s\n", pipeLine(result))
+	}
+	s.lock.Unlock()
+
+	pwd, err := os.Getwd()
+	if err != nil {
+		return fmt.Errorf("pwd: %w", err)
+	}
+	win, err := newWindow(pwd + "/+Pipe")
+	if err != nil {
+		return err
+	}
+
+	// The command may take a while, don't block the event loop
+	dir := s.dir()
+	go func() {
+		defer win.CloseFiles()
+		out, err := pipeCommand(ctx, dir, command, sb.String())
+		if len(out) > 0 {
+			win.Write("body", out)
+		}
+		if err != nil {
+			win.Fprintf("body", "%s: %v\n", command, err)
+		}
+		win.Ctl("clean")
+	}()
+	return nil
+}
+
+// pipeCommand runs command in a shell within dir, rc as Acme does when
+// installed, returning its combined output
+func pipeCommand(ctx context.Context, dir, command, input string) ([]byte, error) {
+	shell := "rc"
+	if _, err := exec.LookPath(shell); err != nil {
+		shell = "sh"
+	}
+	cmd := exec.CommandContext(ctx, shell, "-c", command)
+	cmd.Dir = dir // where result paths are relative to
+	cmd.Stdin = strings.NewReader(input)
+	return cmd.CombinedOutput()
+}
+
+// pipeLine formats result as file:line.col: text, or just its text should
+// it have no address
+func pipeLine(result *Result) string {
+	addr := result.Addr
+	if addr == nil {
+		return result.Text
+	}
+	s := addr.File
+	if addr.FromLine != "" {
+		s += ":" + addr.FromLine
+		if addr.FromColumn != "" {
+			s += "." + addr.FromColumn
+		}
+	}
+	return s + ": " + result.Text
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"9fans.net/go/acme"
+	"9fans.net/go/plan9"
+	"9fans.net/go/plumb"
+)
+
+// Target is a file to open, at an Acme address within it if any
+type Target struct {
+	File    string
+	Address string
+}
+
+// plumbTarget is where to open result, if anywhere
+func plumbTarget(result *Result) (Target, bool) {
+	switch {
+	case result.Addr != nil:
+		return Target{result.Addr.File, result.Addr.Address()}, true
+	case result.Source != nil && result.Source.Paths:
+		return Target{File: result.Text}, true // a path, as from +f or +w
+	}
+	return Target{}, false
+}
+
+// plumb sends a message for each target to the plumber, from Search and
+// relative to the search root, opening them directly should no plumber be
+// running or a message fail
+func (s *Search) plumb(targets ...Target) error {
+	dir := s.dir()
+	fid, err := plumb.Open("send", plan9.OWRITE)
+	if err != nil {
+		for _, target := range targets {
+			err := openTarget(dir, target)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	defer fid.Close()
+
+	for _, target := range targets {
+		msg := &plumb.Message{
+			Src:  "Search",
+			Dir:  dir,
+			Type: "text",
+			Data: []byte(target.File),
+		}
+		if target.Address != "" {
+			// As well as in the data, for rules matching file:addr
+			msg.Data = []byte(target.File + ":" + target.Address)
+			msg.Attr = &plumb.Attribute{Name: "addr", Value: target.Address}
+		}
+		err := msg.Send(fid)
+		if err != nil {
+			if err := openTarget(dir, target); err != nil {
+				return fmt.Errorf("open %s: %w", target.File, err)
+			}
+		}
+	}
+	return nil
+}
+
+// dir is the search root, that result paths are relative to
+func (s *Search) dir() string {
+	s.lock.Lock()
+	root := s.root
+	s.lock.Unlock()
+
+	if root != "" {
+		return root
+	}
+	pwd, err := os.Getwd()
+	if err != nil {
+		return "."
+	}
+	return pwd
+}
+
+// openTarget opens target in Acme at its address, in the window of its
+// file should there be one
+func openTarget(dir string, target Target) error {
+	file := target.File
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(dir, file)
+	}
+
+	win, err := fileWindow(file)
+	if err != nil {
+		return err
+	}
+	defer win.CloseFiles()
+	if target.Address != "" {
+		err = win.Addr("%s", target.Address)
+		if err != nil {
+			return fmt.Errorf("addr: %w", err)
+		}
+		err = win.Ctl("dot=addr")
+		if err != nil {
+			return fmt.Errorf("dot=addr: %w", err)
+		}
+	}
+	err = win.Ctl("show")
+	if err != nil {
+		return fmt.Errorf("show: %w", err)
+	}
+	return nil
+}
+
+// fileWindow opens the Acme window of file, creating one should there be
+// none
+func fileWindow(file string) (*acme.Win, error) {
+	windows, err := acme.Windows()
+	if err != nil {
+		return nil, fmt.Errorf("windows: %w", err)
+	}
+	for _, info := range windows {
+		if filepath.Clean(info.Name) == file {
+			win, err := acme.Open(info.ID, nil)
+			if err != nil {
+				return nil, fmt.Errorf("open acme win: %w", err)
+			}
+			return win, nil
+		}
+	}
+
+	return newWindow(file, "get")
+}
+
+// newWindow opens a window named name and sends it each of ctls,
+// deleting it again should any step fail
+func newWindow(name string, ctls ...string) (*acme.Win, error) {
+	win, err := acme.New()
+	if err != nil {
+		return nil, fmt.Errorf("new acme win: %w", err)
+	}
+	err = win.Name("%s", name)
+	if err != nil {
+		win.Del(true)
+		win.CloseFiles()
+		return nil, fmt.Errorf("name: %w", err)
+	}
+	for _, ctl := range ctls {
+		err = win.Ctl("%s", ctl)
+		if err != nil {
+			win.Del(true)
+			win.CloseFiles()
+			return nil, fmt.Errorf("%s: %w", ctl, err)
+		}
+	}
+	return win, nil
+}
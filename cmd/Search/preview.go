@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"9fans.net/go/acme"
+)
+
+// Preview toggles showing looked at results in a +Preview window, in place
+// of plumbing them
+func (s *Search) Preview() error {
+	s.lock.Lock()
+	s.preview = !s.preview
+	s.lock.Unlock()
+	return nil
+}
+
+// showPreview writes the lines around result to the +Preview window,
+// selecting its match, or else its line, reporting false should result not name a file.
+// Called from the event loop.
+func (s *Search) showPreview(result *Result) (bool, error) {
+	target, ok := plumbTarget(result)
+	if !ok {
+		return false, nil
+	}
+	file, line := target.File, 1
+	if result.Addr != nil {
+		if n, err := strconv.Atoi(result.Addr.FromLine); err == nil {
+			line = n
+		}
+	}
+
+	name := file
+	if !filepath.IsAbs(name) {
+		name = filepath.Join(s.dir(), name)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return true, fmt.Errorf("open: %w", err)
+	}
+	defer f.Close()
+
+	var sb runeBuilder
+	fmt.Fprintf(&sb, "%s:%d\n", file, line)
+	var q0, q1 int // the selection, in runes
+	r := bufio.NewReader(f)
+	for n := 1; n <= line+PreviewLines; n++ {
+		text, truncated, err := readLine(r, MaxLineLength)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return true, fmt.Errorf("read: %w", err)
+		}
+		if n < line-PreviewLines {
+			continue
+		}
+		if n != line {
+			fmt.Fprintf(&sb, "  %-5d %s\n", n, truncateText(text, truncated))
+			continue
+		}
+		q0 = sb.Runes()
+		fmt.Fprintf(&sb, "→ %-5d ", n)
+		if m0, m1, ok := matchRange(result, text); ok {
+			q0, q1 = sb.Runes()+m0, sb.Runes()+m1
+		}
+		fmt.Fprintf(&sb, "%s\n", truncateText(text, truncated))
+		if q1 == 0 {
+			q1 = sb.Runes()
+		}
+	}
+
+	win, err := s.previewWindow()
+	if err != nil {
+		return true, err
+	}
+	err = win.Addr("0,$")
+	if err != nil {
+		return true, fmt.Errorf("addr: %w", err)
+	}
+	_, err = win.Write("data", []byte(sb.String()))
+	if err != nil {
+		return true, fmt.Errorf("write: %w", err)
+	}
+	err = win.Ctl("clean")
+	if err != nil {
+		return true, fmt.Errorf("clean: %w", err)
+	}
+	err = win.Addr("#%d,#%d", q0, q1)
+	if err != nil {
+		return true, fmt.Errorf("addr: %w", err)
+	}
+	err = win.Ctl("dot=addr")
+	if err != nil {
+		return true, fmt.Errorf("dot=addr: %w", err)
+	}
+	err = win.Ctl("show")
+	if err != nil {
+		return true, fmt.Errorf("show: %w", err)
+	}
+	return true, nil
+}
+
+// matchRange finds the rune range within text, the line previewed, of the
+// first of result's matches, should the line still hold it
+func matchRange(result *Result, text string) (int, int, bool) {
+	if len(result.Matches) == 0 || strings.Contains(result.Text, "\n") {
+		return 0, 0, false // matches offset from the first of several lines
+	}
+	m := result.Matches[0]
+	if m.End > len(text) || m.End > len(result.Text) || text[m.Start:m.End] != result.Text[m.Start:m.End] {
+		return 0, 0, false
+	}
+	return utf8.RuneCountInString(text[:m.Start]), utf8.RuneCountInString(text[:m.End]), true
+}
+
+// previewWindow returns the +Preview window, opening it anew should it
+// not exist or have been deleted
+func (s *Search) previewWindow() (*acme.Win, error) {
+	if s.previewWin != nil {
+		if _, err := s.previewWin.Info(); err == nil {
+			return s.previewWin, nil
+		}
+		s.previewWin.CloseFiles() // deleted
+		s.previewWin = nil
+	}
+
+	pwd, err := os.Getwd()
+	if err != nil {
+		return nil, fmt.Errorf("pwd: %w", err)
+	}
+	win, err := newWindow(pwd + "/+Preview")
+	if err != nil {
+		return nil, err
+	}
+	s.previewWin = win
+	return win, nil
+}
+
+// closePreview deletes the +Preview window, when the +Search window is
+// deleted
+func (s *Search) closePreview() {
+	if s.previewWin == nil {
+		return
+	}
+	s.previewWin.Del(true)
+	s.previewWin.CloseFiles()
+	s.previewWin = nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"container/heap"
+	"slices"
+)
+
+// TopResults retains the K highest scoring results seen, holding at most
+// PerFile results from any one file. Results are deduplicated by Addr, or
+// by Source and Text for those without one, as they are inserted, so
+// memory stays bounded regardless of how much output the sources produce.
+type TopResults struct {
+	K       int
+	PerFile int
+
+	heap    rankedHeap // min-heap, lowest ranked result at the root
+	byKey   map[resultKey]*ranked
+	byFile  map[string][]*ranked
+	version int // incremented whenever the retained set changes
+}
+
+func NewTopResults(k, perFile int) *TopResults {
+	return &TopResults{
+		K:       k,
+		PerFile: perFile,
+		byKey:   make(map[resultKey]*ranked),
+		byFile:  make(map[string][]*ranked),
+	}
+}
+
+// resultKey identifies a result, by its address or else its source and text
+type resultKey struct {
+	addr   Addr
+	source *Source
+	text   string
+}
+
+func keyOf(result *Result) resultKey {
+	if result.Addr != nil {
+		return resultKey{addr: *result.Addr}
+	}
+	return resultKey{source: result.Source, text: result.Text}
+}
+
+type ranked struct {
+	result *Result
+	index  int // index within rankedHeap
+}
+
+type rankedHeap []*ranked
+
+func (h rankedHeap) Len() int           { return len(h) }
+func (h rankedHeap) Less(i, j int) bool { return h[i].result.Compare(h[j].result) < 0 }
+func (h rankedHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *rankedHeap) Push(x any) {
+	r := x.(*ranked)
+	r.index = len(*h)
+	*h = append(*h, r)
+}
+
+func (h *rankedHeap) Pop() any {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	old[n-1] = nil
+	*h = old[0 : n-1]
+	return x
+}
+
+// Insert offers a result, reporting whether it was retained.
+func (t *TopResults) Insert(result *Result) bool {
+	if t.K <= 0 {
+		return false
+	}
+	// Keep only the best result at an address
+	if r, ok := t.byKey[keyOf(result)]; ok {
+		if result.Compare(r.result) <= 0 {
+			return false
+		}
+		t.remove(r)
+	}
+	if result.Addr != nil {
+		// Displace the worst result in a full file
+		if rs := t.byFile[result.Addr.File]; t.PerFile > 0 && len(rs) >= t.PerFile {
+			worst := rs[0]
+			for _, r := range rs[1:] {
+				if r.result.Compare(worst.result) < 0 {
+					worst = r
+				}
+			}
+			if result.Compare(worst.result) <= 0 {
+				return false
+			}
+			t.remove(worst)
+		}
+	}
+	if t.heap.Len() >= t.K {
+		if result.Compare(t.heap[0].result) <= 0 {
+			return false
+		}
+		t.remove(t.heap[0])
+	}
+
+	r := &ranked{result: result}
+	heap.Push(&t.heap, r)
+	t.byKey[keyOf(result)] = r
+	if result.Addr != nil {
+		t.byFile[result.Addr.File] = append(t.byFile[result.Addr.File], r)
+	}
+	t.version++
+	return true
+}
+
+func (t *TopResults) remove(r *ranked) {
+	heap.Remove(&t.heap, r.index)
+	delete(t.byKey, keyOf(r.result))
+	if r.result.Addr != nil {
+		file := r.result.Addr.File
+		t.byFile[file] = slices.DeleteFunc(t.byFile[file], func(o *ranked) bool { return o == r })
+		if len(t.byFile[file]) == 0 {
+			delete(t.byFile, file)
+		}
+	}
+	t.version++
+}
+
+func (t *TopResults) Len() int {
+	return t.heap.Len()
+}
+
+// Version changes whenever the retained set changes.
+func (t *TopResults) Version() int {
+	return t.version
+}
+
+// Sorted returns the retained results from highest to lowest ranked,
+// leaving the retained set untouched.
+func (t *TopResults) Sorted() []*Result {
+	results := make([]*Result, len(t.heap))
+	for i, r := range t.heap {
+		results[i] = r.result
+	}
+	slices.SortStableFunc(results, func(a, b *Result) int { return b.Compare(a) })
+	return results
+}
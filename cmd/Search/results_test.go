@@ -0,0 +1,121 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"testing"
+
+	"github.com/cptaffe/acme-search/fuzzy"
+)
+
+// result at line of file, scoring score
+func result(file string, line int, score fuzzy.Score) *Result {
+	return &Result{
+		Text:  file + ":" + strconv.Itoa(line),
+		Addr:  &Addr{File: file, FromLine: strconv.Itoa(line)},
+		Score: score,
+	}
+}
+
+// scores of results, in order
+func scores(results []*Result) []fuzzy.Score {
+	var s []fuzzy.Score
+	for _, r := range results {
+		s = append(s, r.Score)
+	}
+	return s
+}
+
+func TestTopResultsEviction(t *testing.T) {
+	top := NewTopResults(3, 0)
+	for i, score := range []fuzzy.Score{2, 5, 1, 4, 3} {
+		top.Insert(result("a.go", i+1, score))
+	}
+	if got, want := scores(top.Sorted()), []fuzzy.Score{5, 4, 3}; !slices.Equal(got, want) {
+		t.Errorf("retained %v, want %v", got, want)
+	}
+	if top.Insert(result("b.go", 1, 3)) {
+		t.Errorf("retained a result tying the lowest of a full set")
+	}
+	if !top.Insert(result("b.go", 2, 6)) {
+		t.Errorf("did not retain a result above the lowest of a full set")
+	}
+	if got, want := scores(top.Sorted()), []fuzzy.Score{6, 5, 4}; !slices.Equal(got, want) {
+		t.Errorf("retained %v, want %v", got, want)
+	}
+}
+
+func TestTopResultsPerFile(t *testing.T) {
+	top := NewTopResults(10, 2)
+	top.Insert(result("a.go", 1, 3))
+	top.Insert(result("a.go", 2, 5))
+	top.Insert(result("b.go", 1, 1))
+	if top.Insert(result("a.go", 3, 2)) {
+		t.Errorf("retained a result below the worst of a full file")
+	}
+	if !top.Insert(result("a.go", 4, 4)) {
+		t.Errorf("did not displace the worst of a full file")
+	}
+	var lines []string
+	for _, r := range top.Sorted() {
+		lines = append(lines, r.Addr.File+":"+r.Addr.FromLine)
+	}
+	if want := []string{"a.go:2", "a.go:4", "b.go:1"}; !slices.Equal(lines, want) {
+		t.Errorf("retained %v, want %v", lines, want)
+	}
+}
+
+func TestTopResultsDuplicates(t *testing.T) {
+	src := &Source{Name: "test"}
+	tests := []struct {
+		name          string
+		worse, better *Result
+	}{
+		{"address", result("a.go", 1, 1), result("a.go", 1, 2)},
+		{"text", &Result{Text: "a.go", Score: 1, Source: src}, &Result{Text: "a.go", Score: 2, Source: src}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			top := NewTopResults(10, 0)
+			top.Insert(tt.worse)
+			if !top.Insert(tt.better) {
+				t.Errorf("better duplicate not retained")
+			}
+			if top.Insert(tt.worse) {
+				t.Errorf("worse duplicate retained")
+			}
+			if got := top.Sorted(); len(got) != 1 || got[0] != tt.better {
+				t.Errorf("retained %v, want only the better duplicate", scores(got))
+			}
+		})
+	}
+
+	// Without an address, the same text from different sources is kept
+	top := NewTopResults(10, 0)
+	top.Insert(&Result{Text: "a.go", Score: 1, Source: src})
+	top.Insert(&Result{Text: "a.go", Score: 1, Source: &Source{Name: "other"}})
+	if top.Len() != 2 {
+		t.Errorf("retained %d results, want one from each source", top.Len())
+	}
+}
+
+func TestTopResultsSorted(t *testing.T) {
+	top := NewTopResults(5, 0)
+	for i, score := range []fuzzy.Score{3, 1, 4, 1.5, 2} {
+		top.Insert(result("a.go", i+1, score))
+	}
+	version := top.Version()
+	first := top.Sorted()
+	second := top.Sorted()
+	if !slices.Equal(first, second) || top.Len() != 5 || top.Version() != version {
+		t.Errorf("Sorted changed the retained set, %v then %v", scores(first), scores(second))
+	}
+	if want := []fuzzy.Score{4, 3, 2, 1.5, 1}; !slices.Equal(scores(first), want) {
+		t.Errorf("sorted %v, want %v", scores(first), want)
+	}
+	// Retention is unaffected, the lowest is still evicted first
+	top.Insert(result("a.go", 6, 5))
+	if want := []fuzzy.Score{5, 4, 3, 2, 1.5}; !slices.Equal(scores(top.Sorted()), want) {
+		t.Errorf("after insert %v, want %v", scores(top.Sorted()), want)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Status of a source during a search
+type Status struct {
+	Source  *Source
+	Results int // results scoring above zero
+	Done    bool
+	Err     error
+	Elapsed time.Duration // until done
+}
+
+// sourceDone reports a source finishing, with any error
+type sourceDone struct {
+	src *Source
+	err error
+}
+
+func (st Status) String() string {
+	s := fmt.Sprintf("+%c %s: ", st.Source.Flag, st.Source.Name)
+	switch {
+	case errors.Is(st.Err, exec.ErrNotFound):
+		return s + "not installed"
+	case errors.Is(st.Err, context.DeadlineExceeded):
+		return s + fmt.Sprintf("timed out after %s, %d results", st.Elapsed.Round(time.Millisecond), st.Results)
+	case st.Err != nil:
+		return s + st.Err.Error()
+	case !st.Done:
+		return s + fmt.Sprintf("running, %d results", st.Results)
+	default:
+		return s + fmt.Sprintf("%d results in %s", st.Results, st.Elapsed.Round(time.Millisecond))
+	}
+}
+
+// statusLine summarizes the sources of a search on one line
+func statusLine(statuses []Status) string {
+	parts := make([]string, len(statuses))
+	for i, st := range statuses {
+		parts[i] = st.String()
+	}
+	return strings.Join(parts, "; ")
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+)
+
+// treeNode is a directory or file in the tree of results
+type treeNode struct {
+	name     string
+	children map[string]*treeNode
+	result   *Result   // naming this node's path, as from +f or +w
+	results  []*Result // within this node's file, by line
+}
+
+func (n *treeNode) child(name string) *treeNode {
+	if n.children == nil {
+		n.children = make(map[string]*treeNode)
+	}
+	child, ok := n.children[name]
+	if !ok {
+		child = &treeNode{name: name}
+		n.children[name] = child
+	}
+	return child
+}
+
+// dir reports whether the node holds only other nodes
+func (n *treeNode) dir() bool {
+	return n.result == nil && len(n.results) == 0
+}
+
+// buildTree places results by the directories of their paths
+func buildTree(results []*Result) *treeNode {
+	root := &treeNode{}
+	for _, result := range results {
+		p := result.Path()
+		node := root
+		if strings.HasPrefix(p, "/") {
+			node = node.child("/")
+		}
+		for _, name := range strings.Split(p, "/") {
+			if name != "" {
+				node = node.child(name)
+			}
+		}
+		if result.Addr == nil {
+			node.result = result
+			continue
+		}
+		i, _ := slices.BinarySearchFunc(node.results, result, compareLines)
+		node.results = slices.Insert(node.results, i, result)
+	}
+	for _, child := range root.children {
+		child.collapse()
+	}
+	return root
+}
+
+// collapse merges chains of directories holding a single directory, so
+// that a common prefix takes a single line
+func (n *treeNode) collapse() {
+	for n.dir() && len(n.children) == 1 {
+		var only *treeNode
+		for _, child := range n.children {
+			only = child
+		}
+		if !only.dir() || len(only.children) == 0 {
+			break
+		}
+		n.name = path.Join(n.name, only.name)
+		n.children = only.children
+	}
+	for _, child := range n.children {
+		child.collapse()
+	}
+}
+
+// writeTree writes results as an indented tree of the directories holding
+// them. Called with s.lock held.
+func (s *Search) writeTree(sb *runeBuilder, results []*Result, hidden map[string]int) {
+	s.writeNode(sb, buildTree(results), "", hidden)
+}
+
+func (s *Search) writeNode(sb *runeBuilder, node *treeNode, indent string, hidden map[string]int) {
+	names := make([]string, 0, len(node.children))
+	for name := range node.children {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		child := node.children[name]
+		switch {
+		case child.result != nil:
+			s.writeResult(sb, child.result, indent, child.name)
+		case len(child.results) > 0:
+			file := child.results[0].Addr.File
+			s.writeHeader(sb, file, indent, child.name, hidden[file])
+		default:
+			fmt.Fprintf(sb, "%s%s/\n", indent, strings.TrimSuffix(child.name, "/"))
+		}
+		s.writeLines(sb, child.results, indent+"\t")
+		s.writeNode(sb, child, indent+"\t", hidden)
+	}
+}
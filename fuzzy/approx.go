@@ -0,0 +1,165 @@
+package fuzzy
+
+import (
+	"slices"
+	"unicode/utf8"
+)
+
+// Approx holds the variants of a needle within some edits, generated once
+// to score many haystacks: transposing adjacent characters, or dropping
+// one, which also covers a mistyped character.
+//
+// At most one edit per four characters of needle is allowed, so that
+// short needles do not degrade into matching everything.
+type Approx struct {
+	needle   string
+	variants [][]string // variants[e-1] are e edits from needle
+}
+
+// NewApprox generates the variants of needle within maxEdits edits
+func NewApprox(needle string, maxEdits int) *Approx {
+	a := &Approx{needle: needle}
+	maxEdits = min(maxEdits, utf8.RuneCountInString(needle)/4)
+	seen := map[string]bool{needle: true}
+	frontier := []string{needle}
+	for edits := 1; edits <= maxEdits; edits++ {
+		var next []string
+		for _, s := range frontier {
+			for _, variant := range variants(s) {
+				if !seen[variant] {
+					seen[variant] = true
+					next = append(next, variant)
+				}
+			}
+		}
+		a.variants = append(a.variants, next)
+		frontier = next
+	}
+	return a
+}
+
+// MatchApprox scores needle against haystack like Match, but when needle
+// does not match tries again with up to maxEdits edits to needle, see
+// Approx. Each edit adds Options.Edit to the score. Returns the number of
+// edits used, zero for an exact subsequence match.
+func (m *Matcher) MatchApprox(needle string, haystack string, maxEdits int) (Score, int) {
+	return m.MatchApproxWith(NewApprox(needle, maxEdits), haystack)
+}
+
+// MatchApproxWith scores like MatchApprox with the variants of a, so that
+// they are generated once for many haystacks. Whether case matters is
+// decided by the needle for every variant.
+func (m *Matcher) MatchApproxWith(a *Approx, haystack string) (Score, int) {
+	if score := m.Match(a.needle, haystack); score != MinScore || len(a.variants) == 0 {
+		return score, 0
+	}
+
+	// Each edit loses at most one character of the longest common
+	// subsequence, so rule out haystacks too far from needle before
+	// scoring any variant: first by the characters of needle found at all,
+	// which bound that length, then by the length itself
+	m.reset(a.needle, haystack) // haystack is decoded once for every variant
+	fold := m.fold()
+	common := m.found()
+	if common >= len(m.needle)-len(a.variants) {
+		common = m.commonLength()
+	}
+	for i, variants := range a.variants {
+		edits := i + 1
+		if common < len(m.needle)-edits {
+			continue
+		}
+		best, bestVariant := MinScore, ""
+		for _, variant := range variants {
+			m.needle = appendRunes(m.needle[:0], variant)
+			if fold {
+				lower(m.needle)
+			}
+			if len(m.needle) > len(m.haystack) || !m.hasMatch() {
+				continue
+			}
+			if score := m.match(); score > best {
+				best, bestVariant = score, variant
+			}
+		}
+		if best != MinScore {
+			if m.options().Path {
+				best += m.basename(bestVariant, haystack)
+			}
+			return best + Score(edits)*m.options().Edit, edits
+		}
+	}
+	return MinScore, 0
+}
+
+// MatchApproxAll scores each of haystacks like MatchApproxWith, in
+// parallel like MatchAll, returning the scores and edits used.
+func (m *Matcher) MatchApproxAll(a *Approx, haystacks []string) ([]Score, []int) {
+	scores := make([]Score, len(haystacks))
+	edits := make([]int, len(haystacks))
+	m.parallel(len(haystacks), func(worker *Matcher, i int) {
+		scores[i], edits[i] = worker.MatchApproxWith(a, haystacks[i])
+	})
+	return scores, edits
+}
+
+// found counts the runes of the needle of the last reset found anywhere in
+// its haystack
+func (m *Matcher) found() int {
+	n := 0
+	for _, r := range m.needle {
+		if slices.Contains(m.haystack, r) {
+			n++
+		}
+	}
+	return n
+}
+
+// commonLength is the length of the longest common subsequence of the
+// needle and haystack of the last reset
+func (m *Matcher) commonLength() int {
+	// Two rows of the table, by needle rune
+	m.common = slices.Grow(m.common[:0], 2*(len(m.haystack)+1))[:2*(len(m.haystack)+1)]
+	prev, curr := m.common[:len(m.haystack)+1], m.common[len(m.haystack)+1:]
+	clear(prev)
+	for _, nr := range m.needle {
+		curr[0] = 0
+		for j, hr := range m.haystack {
+			if nr == hr {
+				curr[j+1] = prev[j] + 1
+			} else if prev[j+1] > curr[j] {
+				curr[j+1] = prev[j+1]
+			} else {
+				curr[j+1] = curr[j]
+			}
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(m.haystack)]
+}
+
+// variants of s one edit away
+func variants(s string) []string {
+	rs := []rune(s)
+	var vs []string
+	for i := range rs {
+		// Drop a character
+		vs = append(vs, string(rs[:i])+string(rs[i+1:]))
+
+		// Transpose a character with the next
+		if i+1 < len(rs) && rs[i] != rs[i+1] {
+			t := []rune(s)
+			t[i], t[i+1] = t[i+1], t[i]
+			vs = append(vs, string(t))
+		}
+	}
+	return vs
+}
+
+// MatchApprox scores needle against haystack allowing up to maxEdits
+// edits, using DefaultOptions.
+func MatchApprox(needle string, haystack string, maxEdits int) (Score, int) {
+	m := matchers.Get().(*Matcher)
+	defer matchers.Put(m)
+	return m.MatchApprox(needle, haystack, maxEdits)
+}
@@ -0,0 +1,111 @@
+package fuzzy
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Explanation breaks a score down into the contribution of each matched
+// character, to make ranking observable.
+type Explanation struct {
+	Score     Score
+	Positions []int       // rune index in haystack of each rune of needle
+	Matches   []CharScore // one per rune of needle
+	Trailing  Score       // penalty for characters after the last match
+	Basename  Score       // score of the final path component, see Options.Path
+}
+
+// CharScore is the contribution of one matched character
+type CharScore struct {
+	Rune        rune
+	Position    int   // rune index in haystack
+	Gap         int   // characters skipped since the previous match
+	GapScore    Score // penalty for the skipped characters
+	Bonus       Score // word boundary bonus, or consecutive match bonus
+	Consecutive bool  // directly follows the previous match
+}
+
+func (c CharScore) String() string {
+	s := fmt.Sprintf("%q@%d", c.Rune, c.Position)
+	if c.Gap > 0 {
+		s += fmt.Sprintf(" gap %d %+.3f", c.Gap, c.GapScore)
+	}
+	if c.Consecutive {
+		s += fmt.Sprintf(" consecutive %+.3f", c.Bonus)
+	} else if c.Bonus != 0 {
+		s += fmt.Sprintf(" bonus %+.3f", c.Bonus)
+	}
+	return s
+}
+
+func (e *Explanation) String() string {
+	if e.Matches == nil {
+		return "no match"
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "score %.3f:", e.Score)
+	for _, c := range e.Matches {
+		fmt.Fprintf(&sb, " %s;", c)
+	}
+	if e.Trailing != 0 {
+		fmt.Fprintf(&sb, " trailing %+.3f;", e.Trailing)
+	}
+	if e.Basename != 0 {
+		fmt.Fprintf(&sb, " basename %+.3f", e.Basename)
+	}
+	return strings.TrimSuffix(sb.String(), ";")
+}
+
+// Explain scores needle against haystack like MatchPositions, breaking
+// the score down by matched character. Matches is nil when needle does
+// not match.
+func (m *Matcher) Explain(needle string, haystack string) *Explanation {
+	if needle == "" {
+		return &Explanation{Score: MinScore}
+	}
+
+	m.reset(needle, haystack)
+	if len(m.needle) > len(m.haystack) {
+		return &Explanation{Score: MinScore}
+	}
+
+	opts := m.options()
+	D, M := m.matrices()
+	e := &Explanation{Score: M[len(m.needle)-1][len(m.haystack)-1]}
+	if e.Score == MinScore {
+		return e
+	}
+	e.Positions = m.backtrack(D, M)
+
+	haystackRunes := []rune(haystack)
+	for i, j := range e.Positions {
+		c := CharScore{Rune: haystackRunes[j], Position: j, Bonus: m.matchBonus[j]}
+		if i == 0 {
+			c.Gap = j
+			c.GapScore = Score(j) * opts.GapLeading
+		} else {
+			prev := e.Positions[i-1]
+			c.Gap = j - prev - 1
+			c.GapScore = Score(c.Gap) * opts.GapInner
+			c.Consecutive = c.Gap == 0 && D[i][j] == D[i-1][j-1]+opts.MatchConsecutive
+			if c.Consecutive {
+				c.Bonus = opts.MatchConsecutive
+			}
+		}
+		e.Matches = append(e.Matches, c)
+	}
+	e.Trailing = Score(len(m.haystack)-1-e.Positions[len(e.Positions)-1]) * opts.GapTrailing
+	if opts.Path {
+		e.Basename = m.basename(needle, haystack)
+		e.Score += e.Basename
+	}
+	return e
+}
+
+// Explain breaks down the score of needle against haystack using
+// DefaultOptions.
+func Explain(needle string, haystack string) *Explanation {
+	m := matchers.Get().(*Matcher)
+	defer matchers.Put(m)
+	return m.Explain(needle, haystack)
+}
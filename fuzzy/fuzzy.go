@@ -3,7 +3,10 @@ package fuzzy
 
 import (
 	"math"
+	"runtime"
+	"slices"
 	"strings"
+	"sync"
 	"unicode"
 )
 
@@ -23,33 +26,56 @@ const (
 	ScoreMatchWord        Score = 0.8
 	ScoreMatchCapital     Score = 0.7
 	ScoreMatchDot         Score = 0.6
+	ScoreEdit             Score = -1.0
 )
 
-type matcher struct {
-	// Lowercased
-	needle   string
-	haystack string
+// Matcher scores needles against haystacks, reusing its buffers between
+// calls so that scoring many candidates does not allocate per candidate.
+// A Matcher is not safe for concurrent use; see MatchAll. The zero value
+// scores with DefaultOptions.
+type Matcher struct {
+	opts *Options
+
+	// Lowercased unless matching case-sensitively
+	needle   []rune
+	haystack []rune
 
 	matchBonus []Score
+	D, M       [2][]Score
+	common     []int // see commonLength
+
+	workers []*Matcher // used by MatchAll
+}
+
+// NewMatcher returns a Matcher scoring with opts
+func NewMatcher(opts Options) *Matcher {
+	return &Matcher{opts: &opts}
+}
+
+func (m *Matcher) options() *Options {
+	if m.opts == nil {
+		m.opts = &DefaultOptions
+	}
+	return m.opts
 }
 
-func bonusAt(curr, prev rune) Score {
+func (o *Options) bonusAt(curr, prev rune) Score {
 	var score Score
 	if unicode.IsLetter(curr) || unicode.IsDigit(curr) {
 		switch prev {
 		case '/':
-			return ScoreMatchSlash
+			return o.MatchSlash
 		case '-':
-			return ScoreMatchWord
+			return o.MatchWord
 		case '_':
-			return ScoreMatchWord
+			return o.MatchWord
 		case ' ':
-			return ScoreMatchWord
+			return o.MatchWord
 		case '.':
-			return ScoreMatchDot
+			return o.MatchDot
 		default:
 			if unicode.IsUpper(curr) && unicode.IsLower(prev) {
-				return ScoreMatchCapital
+				return o.MatchCapital
 			}
 			return score
 		}
@@ -57,49 +83,95 @@ func bonusAt(curr, prev rune) Score {
 	return score
 }
 
-func precomputeBonus(haystack string) []Score {
+func (m *Matcher) precomputeBonus() {
 	/* Which positions are beginning of words */
-	matchBonus := make([]Score, len(haystack))
+	opts := m.options()
+	m.matchBonus = grow(m.matchBonus, len(m.haystack))
 	prev := '/'
-	for i, r := range haystack {
-		matchBonus[i] = bonusAt(r, prev)
+	for i, r := range m.haystack {
+		m.matchBonus[i] = opts.bonusAt(r, prev)
 		prev = r
 	}
-	return matchBonus
 }
 
-func newMatcher(needle string, haystack string) *matcher {
-	if len(needle) > len(haystack) {
-		return nil
+// grow returns s resliced to length n, reallocating only when needed
+func grow(s []Score, n int) []Score {
+	if cap(s) < n {
+		return make([]Score, n)
 	}
+	return s[:n]
+}
 
-	return &matcher{
-		needle:     strings.ToLower(needle),
-		haystack:   strings.ToLower(haystack),
-		matchBonus: precomputeBonus(haystack),
+// reset decodes needle and haystack into the reused rune buffers, so
+// that positions and bonuses index runes rather than bytes.
+func (m *Matcher) reset(needle string, haystack string) {
+	m.needle = appendRunes(m.needle[:0], needle)
+	m.haystack = appendRunes(m.haystack[:0], haystack)
+	m.precomputeBonus() // before lowercasing, capitals earn a bonus
+
+	if !m.fold() {
+		return
 	}
+	lower(m.needle)
+	lower(m.haystack)
 }
 
-func (m *matcher) matchRow(i int, nr rune, curr_D []Score, curr_M []Score, last_D []Score, last_M []Score) {
+// fold reports whether the needle of the last reset matches regardless of
+// case, see Options.SmartCase
+func (m *Matcher) fold() bool {
+	return !m.options().SmartCase || !slices.ContainsFunc(m.needle, unicode.IsUpper)
+}
+
+func appendRunes(rs []rune, s string) []rune {
+	for _, r := range s {
+		rs = append(rs, r)
+	}
+	return rs
+}
+
+func lower(rs []rune) {
+	for i, r := range rs {
+		rs[i] = unicode.ToLower(r)
+	}
+}
+
+// hasMatch reports whether needle is a subsequence of haystack, which
+// is much cheaper to rule out than to score.
+func (m *Matcher) hasMatch() bool {
+	j := 0
+	for _, r := range m.needle {
+		for j < len(m.haystack) && m.haystack[j] != r {
+			j++
+		}
+		if j == len(m.haystack) {
+			return false
+		}
+		j++
+	}
+	return true
+}
+
+func (m *Matcher) matchRow(i int, nr rune, curr_D []Score, curr_M []Score, last_D []Score, last_M []Score) {
+	opts := m.options()
 	prevScore := MinScore
 	var gapScore Score
 	if i == len(m.needle)-1 {
-		gapScore = ScoreGapTrailing
+		gapScore = opts.GapTrailing
 	} else {
-		gapScore = ScoreGapInner
+		gapScore = opts.GapInner
 	}
 
 	for j, r := range m.haystack {
 		if nr == r {
 			score := MinScore
 			if i == 0 {
-				score = (Score(j) * ScoreGapLeading) + m.matchBonus[j]
+				score = (Score(j) * opts.GapLeading) + m.matchBonus[j]
 			} else if j > 0 { // i > 0 && j > 0
 				score = max(
 					last_M[j-1]+m.matchBonus[j],
 
 					// consecutive match, doesn't stack with matchBonus
-					last_D[j-1]+ScoreMatchConsecutive,
+					last_D[j-1]+opts.MatchConsecutive,
 				)
 			}
 			curr_D[j] = score
@@ -113,21 +185,20 @@ func (m *matcher) matchRow(i int, nr rune, curr_D []Score, curr_M []Score, last_
 	}
 }
 
-func (m *matcher) Match() Score {
+func (m *Matcher) match() Score {
 	/*
 	 * D[][] Stores the best score for this position ending with a match.
 	 * M[][] Stores the best possible score at this position.
 	 */
-	var D, M [2][]Score
 	for i := range 2 {
-		D[i] = make([]Score, len(m.haystack))
-		M[i] = make([]Score, len(m.haystack))
+		m.D[i] = grow(m.D[i], len(m.haystack))
+		m.M[i] = grow(m.M[i], len(m.haystack))
 	}
 	var (
-		last_D = D[0]
-		last_M = M[0]
-		curr_D = D[1]
-		curr_M = M[1]
+		last_D = m.D[0]
+		last_M = m.M[0]
+		curr_D = m.D[1]
+		curr_M = m.M[1]
 	)
 
 	for i, r := range m.needle {
@@ -140,19 +211,13 @@ func (m *matcher) Match() Score {
 	return last_M[len(m.haystack)-1]
 }
 
-func (m *matcher) MatchPositions() (Score, []int) {
-	/*
-	 * D[][] Stores the best score for this position ending with a match.
-	 * M[][] Stores the best possible score at this position.
-	 */
-	var (
-		positions                                = make([]int, len(m.needle))
-		D                              [][]Score = make([][]Score, len(m.needle))
-		M                              [][]Score = make([][]Score, len(m.needle))
-		last_D, last_M, curr_D, curr_M []Score
-	)
+// matrices computes the full D and M matrices described in match
+func (m *Matcher) matrices() (D, M [][]Score) {
+	var last_D, last_M, curr_D, curr_M []Score
+	D = make([][]Score, len(m.needle))
+	M = make([][]Score, len(m.needle))
 
-	for i, _ := range m.haystack {
+	for i := range m.needle {
 		D[i] = make([]Score, len(m.haystack))
 		M[i] = make([]Score, len(m.haystack))
 	}
@@ -166,8 +231,12 @@ func (m *matcher) MatchPositions() (Score, []int) {
 		last_D = curr_D
 		last_M = curr_M
 	}
+	return D, M
+}
 
-	// Backtrack to find the positions of optimal matching
+// backtrack finds the positions of an optimal match through D and M
+func (m *Matcher) backtrack(D, M [][]Score) []int {
+	positions := make([]int, len(m.needle))
 	matchRequired := false
 	for i, j := len(m.needle)-1, len(m.haystack)-1; i >= 0; i-- {
 		for ; j >= 0; j-- {
@@ -187,23 +256,42 @@ func (m *matcher) MatchPositions() (Score, []int) {
 				 */
 				matchRequired =
 					i != 0 && j != 0 &&
-						M[i][j] == D[i-1][j-1]+ScoreMatchConsecutive
-				j--
+						M[i][j] == D[i-1][j-1]+m.options().MatchConsecutive
 				positions[i] = j
+				j--
 				break
 			}
 		}
 	}
+	return positions
+}
 
-	return M[len(m.needle)-1][len(m.haystack)-1], positions
+func (m *Matcher) matchPositions() (Score, []int) {
+	/*
+	 * D[][] Stores the best score for this position ending with a match.
+	 * M[][] Stores the best possible score at this position.
+	 */
+	D, M := m.matrices()
+	return M[len(m.needle)-1][len(m.haystack)-1], m.backtrack(D, M)
 }
 
-func Match(needle string, haystack string) Score {
+// Match scores needle against haystack, returning MinScore when needle
+// is not a subsequence of haystack.
+func (m *Matcher) Match(needle string, haystack string) Score {
+	score := m.matchString(needle, haystack)
+	if score != MinScore && m.options().Path {
+		score += m.basename(needle, haystack)
+	}
+	return score
+}
+
+func (m *Matcher) matchString(needle string, haystack string) Score {
 	if needle == "" {
 		return MinScore
 	}
 
-	if len(needle) > len(haystack) {
+	m.reset(needle, haystack)
+	if len(m.needle) > len(m.haystack) {
 		/*
 		 * Unreasonably large candidate: return no score
 		 * If it is a valid match it will still be returned, it will
@@ -212,11 +300,21 @@ func Match(needle string, haystack string) Score {
 		return MinScore
 	}
 
-	return newMatcher(needle, haystack).Match()
+	if !m.hasMatch() {
+		return MinScore
+	}
+	return m.match()
 }
 
-func MatchPositions(needle string, haystack string) (Score, []int) {
-	if len(needle) > len(haystack) {
+// MatchPositions scores needle against haystack like Match, also
+// returning the rune index in haystack of each rune of needle.
+func (m *Matcher) MatchPositions(needle string, haystack string) (Score, []int) {
+	if needle == "" {
+		return MinScore, nil
+	}
+
+	m.reset(needle, haystack)
+	if len(m.needle) > len(m.haystack) {
 		/*
 		 * Unreasonably large candidate: return no score
 		 * If it is a valid match it will still be returned, it will
@@ -225,5 +323,80 @@ func MatchPositions(needle string, haystack string) (Score, []int) {
 		return MinScore, nil
 	}
 
-	return newMatcher(needle, haystack).MatchPositions()
+	score, positions := m.matchPositions()
+	if score != MinScore && m.options().Path {
+		score += m.basename(needle, haystack)
+	}
+	return score, positions
+}
+
+// basename scores needle against the final component of path alone, see
+// Options.Path. Zero when needle does not match there.
+func (m *Matcher) basename(needle string, path string) Score {
+	base := path[strings.LastIndexByte(strings.TrimSuffix(path, "/"), '/')+1:]
+	return max(m.matchString(needle, base), 0)
+}
+
+// minBatch is the fewest haystacks worth handing to another goroutine
+const minBatch = 256
+
+// MatchAll scores needle against each of haystacks, spreading the work
+// across GOMAXPROCS goroutines, each with its own reused Matcher.
+func (m *Matcher) MatchAll(needle string, haystacks []string) []Score {
+	scores := make([]Score, len(haystacks))
+	m.parallel(len(haystacks), func(worker *Matcher, i int) {
+		scores[i] = worker.Match(needle, haystacks[i])
+	})
+	return scores
+}
+
+// parallel calls f for each of n haystacks, split between up to
+// GOMAXPROCS of m's workers, or m alone for few haystacks
+func (m *Matcher) parallel(n int, f func(worker *Matcher, i int)) {
+	k := min(runtime.GOMAXPROCS(0), (n+minBatch-1)/minBatch)
+	if k <= 1 {
+		for i := 0; i < n; i++ {
+			f(m, i)
+		}
+		return
+	}
+
+	for len(m.workers) < k {
+		m.workers = append(m.workers, &Matcher{opts: m.options()})
+	}
+	size := (n + k - 1) / k
+	var wg sync.WaitGroup
+	for w, worker := range m.workers[:k] {
+		lo, hi := w*size, min((w+1)*size, n)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := lo; i < hi; i++ {
+				f(worker, i)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// matchers score with DefaultOptions for the package level functions
+var matchers = sync.Pool{New: func() any { return new(Matcher) }}
+
+func Match(needle string, haystack string) Score {
+	m := matchers.Get().(*Matcher)
+	defer matchers.Put(m)
+	return m.Match(needle, haystack)
+}
+
+func MatchPositions(needle string, haystack string) (Score, []int) {
+	m := matchers.Get().(*Matcher)
+	defer matchers.Put(m)
+	return m.MatchPositions(needle, haystack)
+}
+
+// MatchAll scores needle against each of haystacks in parallel
+func MatchAll(needle string, haystacks []string) []Score {
+	m := matchers.Get().(*Matcher)
+	defer matchers.Put(m)
+	return m.MatchAll(needle, haystacks)
 }
@@ -0,0 +1,161 @@
+package fuzzy
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// corpus of repository style paths, n of them
+func corpus(n int) []string {
+	dirs := []string{
+		"cmd/Search", "cmd/L", "internal/lsp/protocol", "internal/lsp/cache",
+		"src/net/http/httputil", "src/runtime/internal/atomic", "pkg/plumb",
+		"vendor/golang.org/x/text/unicode/norm", "docs/images", "test/fixtures",
+	}
+	names := []string{
+		"main", "fuzzy", "options", "explain", "results", "parse", "status",
+		"server", "client", "handler", "reverseproxy", "transport", "atomic",
+	}
+	exts := []string{".go", "_test.go", ".md", ".json"}
+
+	paths := make([]string, 0, n)
+	for i := 0; len(paths) < n; i++ {
+		dir := dirs[i%len(dirs)]
+		name := names[(i/len(dirs))%len(names)]
+		ext := exts[(i/len(dirs)/len(names))%len(exts)]
+		paths = append(paths, fmt.Sprintf("%s/%s%d%s", dir, name, i/(len(dirs)*len(names)*len(exts)), ext))
+	}
+	return paths
+}
+
+var benchNeedles = []string{"main", "lspcache", "httprevprox", "fzy"}
+
+func BenchmarkMatch(b *testing.B) {
+	paths := corpus(4096)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Match(benchNeedles[i%len(benchNeedles)], paths[i%len(paths)])
+	}
+}
+
+func BenchmarkMatcher(b *testing.B) {
+	paths := corpus(4096)
+	m := NewMatcher(PathOptions)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.Match(benchNeedles[i%len(benchNeedles)], paths[i%len(paths)])
+	}
+}
+
+func BenchmarkMatchAll(b *testing.B) {
+	paths := corpus(4096)
+	m := NewMatcher(PathOptions)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.MatchAll(benchNeedles[i%len(benchNeedles)], paths)
+	}
+}
+
+func TestMatchPositionsRunes(t *testing.T) {
+	tests := []struct {
+		needle, haystack string
+		want             []int
+	}{
+		{"wö", "Héllo_wörld", []int{6, 7}},
+		{"hé", "Héllo", []int{0, 1}},
+		{"日本", "東京日本", []int{2, 3}},
+		{"ab", "äaöb", []int{1, 3}},
+	}
+	for _, tt := range tests {
+		score, got := MatchPositions(tt.needle, tt.haystack)
+		if score == MinScore || !slices.Equal(got, tt.want) {
+			t.Errorf("MatchPositions(%q, %q) = %v, %v, want %v", tt.needle, tt.haystack, score, got, tt.want)
+		}
+	}
+}
+
+func TestSmartCase(t *testing.T) {
+	smart := DefaultOptions
+	smart.SmartCase = true
+	tests := []struct {
+		opts             Options
+		needle, haystack string
+		match            bool
+	}{
+		{DefaultOptions, "foo", "Foo", true},
+		{DefaultOptions, "Foo", "foo", true},
+		{DefaultOptions, "ÉTÉ", "été", true},
+		{smart, "foo", "Foo", true},
+		{smart, "Foo", "Foo", true},
+		{smart, "Foo", "foo", false},
+		{smart, "été", "ÉTÉ", true},
+		{smart, "Été", "été", false},
+	}
+	for _, tt := range tests {
+		score := NewMatcher(tt.opts).Match(tt.needle, tt.haystack)
+		if match := score != MinScore; match != tt.match {
+			t.Errorf("Match(%q, %q) with SmartCase %v = %v, want match %v", tt.needle, tt.haystack, tt.opts.SmartCase, score, tt.match)
+		}
+	}
+}
+
+func TestBonusAfterNonASCII(t *testing.T) {
+	tests := []struct {
+		haystack string
+		i        int // rune index
+		want     Score
+	}{
+		{"héllo_wörld", 6, ScoreMatchWord},
+		{"éclair/über", 7, ScoreMatchSlash},
+		{"überÖl", 4, ScoreMatchCapital},
+		{"naïve.ünits", 6, ScoreMatchDot},
+		{"日本語", 1, 0},
+	}
+	for _, tt := range tests {
+		m := NewMatcher(DefaultOptions)
+		m.reset("x", tt.haystack)
+		if got := m.matchBonus[tt.i]; got != tt.want {
+			t.Errorf("bonus of %q at %d = %v, want %v", tt.haystack, tt.i, got, tt.want)
+		}
+	}
+}
+
+func BenchmarkMatchApprox(b *testing.B) {
+	line := strings.Repeat("the quick brown fox jumps over the lazy dog ", 45)
+	for _, needle := range []string{"searchResultsz", "foo.*bar|baz()"} {
+		b.Run(needle, func(b *testing.B) {
+			a := NewApprox(needle, 2)
+			m := NewMatcher(TextOptions)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				m.MatchApproxWith(a, line)
+			}
+		})
+	}
+}
+
+func TestMatchApprox(t *testing.T) {
+	tests := []struct {
+		needle, haystack string
+		edits            int
+	}{
+		{"search", "search", 0},
+		{"saerch", "search", 1},  // transposed
+		{"searxch", "search", 1}, // inserted
+		{"Saerchresults", "searchResults", 1},
+		{"sxearxch", "search", 2},
+		{"abcd", "xyz", 0},
+	}
+	for _, tt := range tests {
+		score, edits := MatchApprox(tt.needle, tt.haystack, 2)
+		if edits != tt.edits || (score == MinScore) != (tt.needle == "abcd") {
+			t.Errorf("MatchApprox(%q, %q) = %v, %d edits, want %d", tt.needle, tt.haystack, score, edits, tt.edits)
+		}
+	}
+}
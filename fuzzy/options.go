@@ -0,0 +1,65 @@
+package fuzzy
+
+// Options tunes how a Matcher ranks matches, so that paths and symbol
+// names can each be scored by their own profile.
+// A zero field scores nothing, so an Options filled in only partially
+// disables the gaps and bonuses it leaves out; start from a copy of
+// DefaultOptions to change only some of them.
+type Options struct {
+	GapLeading       Score // per character skipped before the first match
+	GapTrailing      Score // per character skipped after the last match
+	GapInner         Score // per character skipped between matches
+	MatchConsecutive Score // match directly following another match
+	MatchSlash       Score // match following a path separator
+	MatchWord        Score // match following '-', '_' or ' '
+	MatchCapital     Score // match on a camelCase boundary
+	MatchDot         Score // match following '.'
+	Edit             Score // per edit to the needle, see MatchApprox
+
+	// Path scores the final path component separately, adding its score
+	// to that of the whole path so that matches within the basename rank
+	// above matches spread across directories.
+	Path bool
+
+	// SmartCase matches case-sensitively when the needle contains an
+	// uppercase letter, and case-insensitively otherwise.
+	SmartCase bool
+}
+
+// DefaultOptions scores like fzy and is used by Match
+var DefaultOptions = Options{
+	GapLeading:       ScoreGapLeading,
+	GapTrailing:      ScoreGapTrailing,
+	GapInner:         ScoreGapInner,
+	MatchConsecutive: ScoreMatchConsecutive,
+	MatchSlash:       ScoreMatchSlash,
+	MatchWord:        ScoreMatchWord,
+	MatchCapital:     ScoreMatchCapital,
+	MatchDot:         ScoreMatchDot,
+	Edit:             ScoreEdit,
+}
+
+// PathOptions scores file paths, preferring matches in the basename
+var PathOptions = func() Options {
+	opts := DefaultOptions
+	opts.Path = true
+	opts.SmartCase = true
+	return opts
+}()
+
+// SymbolOptions weights camelCase and qualified name boundaries as
+// highly as word boundaries, e.g. "sR" in "pkg.searchResults".
+var SymbolOptions = func() Options {
+	opts := DefaultOptions
+	opts.MatchCapital = ScoreMatchWord
+	opts.MatchDot = ScoreMatchWord
+	opts.SmartCase = true
+	return opts
+}()
+
+// TextOptions scores lines of text, such as grep results
+var TextOptions = func() Options {
+	opts := DefaultOptions
+	opts.SmartCase = true
+	return opts
+}()